@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/kiteco/go-bsdiff/v2/pkg/bspatch"
+	"github.com/kiteco/go-bsdiff/v2/pkg/filter"
+)
+
+type jsonBlock struct {
+	Codec          string `json:"codec"`
+	Offset         int64  `json:"offset"`
+	CompressedSize int64  `json:"compressedSize"`
+	Size           int64  `json:"size"`
+}
+
+type jsonInfo struct {
+	Magic      string    `json:"magic"`
+	Format     string    `json:"format"`
+	NewSize    int64     `json:"newSize"`
+	Checksum   string    `json:"checksum,omitempty"`
+	OldSum     string    `json:"oldSum,omitempty"`
+	NewSum     string    `json:"newSum,omitempty"`
+	Filter     string    `json:"filter,omitempty"`
+	Ctrl       jsonBlock `json:"ctrl"`
+	Diff       jsonBlock `json:"diff"`
+	Extra      jsonBlock `json:"extra"`
+	Entries    int64     `json:"entries"`
+	DiffBytes  int64     `json:"diffBytes"`
+	Unchanged  int64     `json:"unchangedBytes"`
+	ExtraBytes int64     `json:"extraBytes"`
+}
+
+// inspect implements "bsdiff inspect [-json] patchfile".
+func inspect(args []string) {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print JSON instead of text")
+	fs.Usage = func() {
+		println("usage: " + os.Args[0] + " inspect [-json] patchfile")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	patchf, err := os.Open(fs.Arg(0))
+	if err != nil {
+		println(err.Error())
+		os.Exit(1)
+	}
+	defer patchf.Close()
+	info, err := bspatch.Inspect(patchf)
+	if err != nil {
+		println(err.Error())
+		os.Exit(1)
+	}
+
+	if *asJSON {
+		err = printJSON(os.Stdout, info)
+	} else {
+		err = printText(os.Stdout, info)
+	}
+	if err != nil {
+		println(err.Error())
+		os.Exit(1)
+	}
+}
+
+func printJSON(w io.Writer, info *bspatch.Info) error {
+	block := func(b bspatch.BlockInfo) jsonBlock {
+		return jsonBlock{b.Codec.String(), b.Offset, b.CompressedSize, b.Size}
+	}
+	ji := jsonInfo{
+		Magic:      info.Magic,
+		Format:     info.Format,
+		NewSize:    info.NewSize,
+		OldSum:     hex.EncodeToString(info.OldSum),
+		NewSum:     hex.EncodeToString(info.NewSum),
+		Ctrl:       block(info.Ctrl),
+		Diff:       block(info.Diff),
+		Extra:      block(info.Extra),
+		Entries:    info.Entries,
+		DiffBytes:  info.DiffBytes,
+		Unchanged:  info.Unchanged,
+		ExtraBytes: info.ExtraBytes,
+	}
+	if info.OldSum != nil {
+		ji.Checksum = info.Checksum.String()
+	}
+	if info.Filter != filter.None {
+		ji.Filter = info.Filter.String()
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(ji)
+}
+
+func printText(w io.Writer, info *bspatch.Info) error {
+	p := func(format string, a ...interface{}) {
+		fmt.Fprintf(w, format, a...)
+	}
+	p("format:      %s (%s)\n", info.Format, info.Magic)
+	p("new size:    %d\n", info.NewSize)
+	if info.OldSum != nil {
+		p("old %-7s  %x\n", info.Checksum.String()+":", info.OldSum)
+	}
+	if info.NewSum != nil {
+		p("new %-7s  %x\n", info.Checksum.String()+":", info.NewSum)
+	}
+	if info.Filter != filter.None {
+		p("filter:      %s\n", info.Filter)
+	}
+	p("\n%-6s %-7s %12s %12s %12s\n", "block", "codec", "offset", "compressed", "size")
+	for _, b := range []struct {
+		name string
+		bi   bspatch.BlockInfo
+	}{{"ctrl", info.Ctrl}, {"diff", info.Diff}, {"extra", info.Extra}} {
+		p("%-6s %-7s %12d %12d %12d\n", b.name, b.bi.Codec, b.bi.Offset, b.bi.CompressedSize, b.bi.Size)
+	}
+	p("\ncontrol entries: %d\n", info.Entries)
+	p("from old file:   %d (%s of new), %d unchanged\n", info.DiffBytes, percent(info.DiffBytes, info.NewSize), info.Unchanged)
+	_, err := fmt.Fprintf(w, "from extra:      %d (%s of new)\n", info.ExtraBytes, percent(info.ExtraBytes, info.NewSize))
+	return err
+}
+
+func percent(n, total int64) string {
+	if total == 0 {
+		return "0.0%"
+	}
+	return fmt.Sprintf("%.1f%%", 100*float64(n)/float64(total))
+}
@@ -1,23 +1,112 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"io/ioutil"
 	"os"
 
 	"github.com/kiteco/go-bsdiff/v2/pkg/bsdiff"
 )
 
 func main() {
-	if len(os.Args) != 4 {
+	if len(os.Args) > 1 && os.Args[1] == "inspect" {
+		inspect(os.Args[2:])
+		return
+	}
+	signKey := flag.String("sign-key", "", "sign the patch with the Ed25519 private key in this PEM file")
+	flag.Usage = func() { printusage(1) }
+	flag.Parse()
+	if flag.NArg() != 3 {
 		printusage(1)
 	}
-	err := bsdiff.File(os.Args[1], os.Args[2], os.Args[3])
+	var key ed25519.PrivateKey
+	if *signKey != "" {
+		var err error
+		if key, err = readPrivateKey(*signKey); err != nil {
+			println(err.Error())
+			os.Exit(1)
+		}
+	}
+	oldpath, newpath, patchfile := flag.Arg(0), flag.Arg(1), flag.Arg(2)
+	var err error
+	if fi, serr := os.Stat(oldpath); serr == nil && fi.IsDir() {
+		err = diffDir(oldpath, newpath, patchfile)
+	} else {
+		err = bsdiff.File(oldpath, newpath, patchfile)
+	}
+	if err == nil && key != nil {
+		err = signPatch(patchfile, key)
+	}
 	if err != nil {
 		println(err.Error())
 		printusage(1)
 	}
 }
 
+// diffDir writes a tree patch from olddir to newdir.
+func diffDir(olddir, newdir, patchfile string) error {
+	f, err := os.Create(patchfile)
+	if err != nil {
+		return err
+	}
+	err = bsdiff.Dir(olddir, newdir, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(patchfile)
+	}
+	return err
+}
+
+// readPrivateKey reads an Ed25519 private key from a PEM file holding it
+// in PKCS #8 form, as written by "openssl genpkey -algorithm ed25519".
+func readPrivateKey(name string) (ed25519.PrivateKey, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, errors.New(name + ": no PEM private key")
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := k.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New(name + ": not an Ed25519 private key")
+	}
+	return key, nil
+}
+
+// signPatch replaces patchfile with a signed patch holding it, or adds a
+// signature if it is already signed.
+func signPatch(patchfile string, key ed25519.PrivateKey) error {
+	patch, err := ioutil.ReadFile(patchfile)
+	if err != nil {
+		return err
+	}
+	signed, err := bsdiff.Sign(patch, key)
+	if err != nil {
+		os.Remove(patchfile)
+		return err
+	}
+	if err := ioutil.WriteFile(patchfile, signed, 0644); err != nil {
+		os.Remove(patchfile)
+		return err
+	}
+	return nil
+}
+
 func printusage(exitcode int) {
-	println("usage: " + os.Args[0] + " oldfile newfile patchfile")
+	println("usage: " + os.Args[0] + " [--sign-key keyfile] oldfile newfile patchfile")
+	println("       " + os.Args[0] + " [--sign-key keyfile] olddir newdir patchfile")
+	println("       " + os.Args[0] + " inspect [-json] patchfile")
 	os.Exit(exitcode)
 }
@@ -1,23 +1,130 @@
 package main
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"io/ioutil"
 	"os"
 
 	"github.com/kiteco/go-bsdiff/v2/pkg/bspatch"
 )
 
+// keyFiles collects the files of repeated --verify-key flags.
+type keyFiles []string
+
+func (k *keyFiles) String() string { return "" }
+
+func (k *keyFiles) Set(name string) error {
+	*k = append(*k, name)
+	return nil
+}
+
 func main() {
-	if len(os.Args) != 4 {
+	var verifyKeys keyFiles
+	flag.Var(&verifyKeys, "verify-key", "only apply patches signed by the Ed25519 public key in this PEM `file`; may be repeated")
+	flag.Usage = func() { printusage(1) }
+	flag.Parse()
+	if flag.NArg() != 3 {
 		printusage(1)
 	}
-	err := bspatch.File(os.Args[1], os.Args[2], os.Args[3])
+	oldpath, newpath, patchfile := flag.Arg(0), flag.Arg(1), flag.Arg(2)
+	fi, serr := os.Stat(oldpath)
+	isDir := serr == nil && fi.IsDir()
+	var err error
+	switch {
+	case len(verifyKeys) > 0:
+		err = patchVerified(oldpath, newpath, patchfile, verifyKeys, isDir)
+	case isDir:
+		err = patchDir(oldpath, newpath, patchfile)
+	default:
+		err = bspatch.File(oldpath, newpath, patchfile)
+	}
 	if err != nil {
 		println(err.Error())
 		printusage(1)
 	}
 }
 
+// patchDir applies a tree patch to olddir, creating newdir.
+func patchDir(olddir, newdir, patchfile string) error {
+	f, err := os.Open(patchfile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return bspatch.Dir(olddir, newdir, f)
+}
+
+// patchVerified applies a signed patch to a file or directory once it has
+// checked that one of the keys in keyfiles signed it. Nothing is created
+// for a patch that doesn't verify.
+func patchVerified(oldpath, newpath, patchfile string, keyfiles []string, isDir bool) error {
+	var keys []ed25519.PublicKey
+	for _, name := range keyfiles {
+		key, err := readPublicKey(name)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+	signed, err := ioutil.ReadFile(patchfile)
+	if err != nil {
+		return err
+	}
+	patch, err := bspatch.Verify(signed, keys)
+	if err != nil {
+		return err
+	}
+	if isDir {
+		return bspatch.Dir(oldpath, newpath, bytes.NewReader(patch))
+	}
+	oldf, err := os.Open(oldpath)
+	if err != nil {
+		return err
+	}
+	defer oldf.Close()
+	newf, err := os.Create(newpath)
+	if err != nil {
+		return err
+	}
+	err = bspatch.Apply(oldf, newf, bytes.NewReader(patch))
+	if cerr := newf.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(newpath)
+	}
+	return err
+}
+
+// readPublicKey reads an Ed25519 public key from a PEM file holding it in
+// PKIX form, as written by "openssl pkey -pubout".
+func readPublicKey(name string) (ed25519.PublicKey, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, errors.New(name + ": no PEM public key")
+	}
+	k, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := k.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New(name + ": not an Ed25519 public key")
+	}
+	return key, nil
+}
+
 func printusage(exitcode int) {
-	println("usage: " + os.Args[0] + " oldfile newfile patchfile")
+	println("usage: " + os.Args[0] + " [--verify-key keyfile]... oldfile newfile patchfile")
+	println("       " + os.Args[0] + " [--verify-key keyfile]... olddir newdir patchfile")
 	os.Exit(exitcode)
 }
@@ -0,0 +1,41 @@
+package bsdiff
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/kiteco/go-bsdiff/v2/pkg/bsdiff"
+	"github.com/kiteco/go-bsdiff/v2/pkg/bspatch"
+	"github.com/kiteco/go-bsdiff/v2/pkg/codec"
+)
+
+// FuzzRoundTrip checks that every format patches old into new. Its seed
+// corpus in testdata/fuzz/FuzzRoundTrip holds small ELF executables built
+// from two versions of the same C program, next to the hand-written seeds
+// below.
+func FuzzRoundTrip(f *testing.F) {
+	f.Add([]byte(""), []byte(""))
+	f.Add([]byte(""), []byte("new"))
+	f.Add([]byte("old"), []byte(""))
+	f.Add([]byte("the quick brown fox jumps over the lazy dog"), []byte("the quick brown cat jumps over the lazy dog!"))
+	f.Add(bytes.Repeat([]byte{0}, 1000), bytes.Repeat([]byte{0, 1}, 600))
+	f.Fuzz(func(t *testing.T, oldbs, newbs []byte) {
+		for _, opts := range [][]bsdiff.Option{
+			nil,
+			{bsdiff.WithFormat(bsdiff.FormatClassic)},
+			{bsdiff.WithFormat(bsdiff.FormatExtended), bsdiff.WithCodec(codec.Zstd), bsdiff.WithLevel(codec.BestSpeed)},
+		} {
+			patch, err := bsdiff.Bytes(oldbs, newbs, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			newbs2, err := bspatch.Bytes(oldbs, patch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(newbs, newbs2) {
+				t.Fatalf("patched file differs (%v bytes, expected %v)", len(newbs2), len(newbs))
+			}
+		}
+	})
+}
@@ -1,5 +1,10 @@
 module github.com/kiteco/go-bsdiff/v2
 
-go 1.14
+go 1.22
 
-require github.com/dsnet/compress v0.0.0-20171208185109-cc9eb1d7ad76
+require (
+	github.com/andybalholm/brotli v1.2.0
+	github.com/dsnet/compress v0.0.0-20171208185109-cc9eb1d7ad76
+	github.com/klauspost/compress v1.18.0
+	github.com/ulikunitz/xz v0.5.15
+)
@@ -0,0 +1,111 @@
+package bsdiff
+
+import "io"
+
+// asyncBuffers is the number of buffers of blockBufferSize bytes queued in
+// front of each block's compressor.
+const asyncBuffers = 4
+
+// asyncWriter feeds a block's compressor on its own goroutine, so the three
+// blocks are compressed concurrently with each other and with the scan.
+// Up to asyncBuffers writes are queued; Write blocks once they are all in
+// use.
+type asyncWriter struct {
+	dst  io.WriteCloser
+	full chan []byte
+	free chan []byte
+	cur  []byte
+	// failed is closed once err is set by the compressing goroutine.
+	failed chan struct{}
+	// done is closed once the compressing goroutine has closed dst.
+	done chan struct{}
+	err  error
+}
+
+func newAsyncWriter(dst io.WriteCloser) *asyncWriter {
+	w := &asyncWriter{
+		dst:    dst,
+		full:   make(chan []byte, asyncBuffers),
+		free:   make(chan []byte, asyncBuffers),
+		failed: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	for i := 0; i < asyncBuffers; i++ {
+		w.free <- make([]byte, 0, blockBufferSize)
+	}
+	go w.run(w.full)
+	return w
+}
+
+func (w *asyncWriter) run(full <-chan []byte) {
+	defer close(w.done)
+	var err error
+	for buf := range full {
+		if err == nil {
+			if _, err = w.dst.Write(buf); err != nil {
+				w.err = err
+				close(w.failed)
+			}
+		}
+		w.free <- buf[:0]
+	}
+	if cerr := w.dst.Close(); err == nil && cerr != nil {
+		w.err = cerr
+		close(w.failed)
+	}
+}
+
+func (w *asyncWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		if w.cur == nil {
+			select {
+			case w.cur = <-w.free:
+			case <-w.failed:
+				return written, w.err
+			}
+		}
+		m := copy(w.cur[len(w.cur):cap(w.cur)], p)
+		w.cur = w.cur[:len(w.cur)+m]
+		p = p[m:]
+		written += m
+		if len(w.cur) == cap(w.cur) {
+			if err := w.send(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (w *asyncWriter) send() error {
+	select {
+	case w.full <- w.cur:
+		w.cur = nil
+		return nil
+	case <-w.failed:
+		return w.err
+	}
+}
+
+// stop queues the rest of the input and lets the goroutine close the
+// compressor once it is done, without waiting for it.
+func (w *asyncWriter) stop() {
+	if w.full == nil {
+		return
+	}
+	if len(w.cur) > 0 {
+		// An error is also left in w.err
+		w.send()
+	}
+	close(w.full)
+	w.full = nil
+}
+
+// Close queues the rest of the input and waits for the compressor to
+// finish and be closed.
+func (w *asyncWriter) Close() error {
+	w.stop()
+	<-w.done
+	return w.err
+}
@@ -0,0 +1,82 @@
+package bsdiff
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/kiteco/go-bsdiff/v2/pkg/bspatch"
+	"github.com/kiteco/go-bsdiff/v2/pkg/codec"
+)
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+type failingWriter struct {
+	n int
+}
+
+var errWrite = errors.New("write failed")
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.n -= len(p); w.n < 0 {
+		return 0, errWrite
+	}
+	return len(p), nil
+}
+
+func TestAsyncWriter(t *testing.T) {
+	data := bytes.Repeat([]byte("async writer "), 3*blockBufferSize/13)
+	buf := new(bytes.Buffer)
+	w := newAsyncWriter(nopCloser{buf})
+	for p := data; len(p) > 0; p = p[min(len(p), 1000):] {
+		if _, err := w.Write(p[:min(len(p), 1000)]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatal("asyncWriter changed the data")
+	}
+
+	w = newAsyncWriter(nopCloser{&failingWriter{blockBufferSize}})
+	var err error
+	for i := 0; i < 2*asyncBuffers+2 && err == nil; i++ {
+		_, err = w.Write(data[:blockBufferSize])
+	}
+	if cerr := w.Close(); cerr != errWrite {
+		t.Fatal("expected errWrite from Close, got", cerr)
+	}
+	if err != errWrite {
+		t.Fatal("expected errWrite from Write, got", err)
+	}
+}
+
+func TestBlockConcurrency(t *testing.T) {
+	oldbs, newbs := parallelTestFiles(5, codec.SegmentSize+codec.SegmentSize/2)
+	patch, err := Bytes(oldbs, newbs, WithLevel(codec.BestSpeed), WithBlockConcurrency(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// One stream for each of the control and extra blocks, two for the
+	// diff block
+	if n := bytes.Count(patch, []byte("BZh1")); n < 4 {
+		t.Fatal("found", n, "bzip2 streams")
+	}
+	newbs2, err := bspatch.Bytes(oldbs, patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(newbs, newbs2) {
+		t.Fatal("patch does not reproduce the new file")
+	}
+	if _, err := Bytes(oldbs, newbs, WithFormat(FormatClassic), WithBlockConcurrency(4)); err == nil {
+		t.Fatal("block concurrency should not work with FormatClassic")
+	}
+}
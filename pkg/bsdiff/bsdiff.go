@@ -26,59 +26,88 @@
 package bsdiff
 
 import (
+	"bufio"
 	"bytes"
-	"crypto/sha256"
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 
-	"github.com/dsnet/compress/bzip2"
+	"github.com/kiteco/go-bsdiff/v2/pkg/checksum"
+	"github.com/kiteco/go-bsdiff/v2/pkg/codec"
 	"github.com/kiteco/go-bsdiff/v2/pkg/util"
 )
 
 // Bytes takes the old and new byte slices and outputs the diff
-func Bytes(oldbs, newbs []byte) ([]byte, error) {
-	return diffb(oldbs, newbs)
+func Bytes(oldbs, newbs []byte, opts ...Option) ([]byte, error) {
+	return New(opts...).Bytes(oldbs, newbs)
+}
+
+// DiffContext writes the diff of oldbs and newbs to patchf. It returns
+// ctx.Err() if ctx is done before the diff is complete.
+func DiffContext(ctx context.Context, oldbs, newbs []byte, patchf io.Writer, opts ...Option) error {
+	return New(opts...).DiffContext(ctx, oldbs, newbs, patchf)
 }
 
 // Reader takes the old and new binaries and outputs to a stream of the diff file
-func Reader(oldbin io.Reader, newbin io.Reader, patchf io.Writer) error {
-	oldbs, err := ioutil.ReadAll(oldbin)
-	if err != nil {
-		return err
-	}
-	newbs, err := ioutil.ReadAll(newbin)
-	if err != nil {
-		return err
-	}
-	diffbytes, err := diffb(oldbs, newbs)
-	if err != nil {
-		return err
-	}
-	return util.PutWriter(patchf, diffbytes)
+func Reader(oldbin io.Reader, newbin io.Reader, patchf io.Writer, opts ...Option) error {
+	return New(opts...).Reader(oldbin, newbin, patchf)
 }
 
 // File reads the old and new files to create a diff patch file
-func File(oldfile, newfile, patchfile string) error {
-	oldbs, err := ioutil.ReadFile(oldfile)
-	if err != nil {
-		return fmt.Errorf("could not read oldfile '%v': %v", oldfile, err.Error())
-	}
-	newbs, err := ioutil.ReadFile(newfile)
-	if err != nil {
-		return fmt.Errorf("could not read newfile '%v': %v", newfile, err.Error())
+func File(oldfile, newfile, patchfile string, opts ...Option) error {
+	return New(opts...).File(oldfile, newfile, patchfile)
+}
+
+// progressInterval is how many bytes of the new file are scanned between
+// checks of the context and calls to the progress callback.
+const progressInterval = 64 * 1024
+
+func diffb(ctx context.Context, oldbin, newbin []byte, cfg *config) ([]byte, error) {
+	// Both files and the patch, which is rarely larger than the new file,
+	// are held in memory
+	if err := cfg.checkMemory(len(oldbin), int64(len(oldbin))+2*int64(len(newbin))); err != nil {
+		return nil, err
 	}
-	diffbytes, err := diffb(oldbs, newbs)
-	if err != nil {
-		return fmt.Errorf("bsdiff: %v", err.Error())
+	return newIndex(oldbin, cfg).diffb(ctx, newbin)
+}
+
+func (ix *Index) diffb(ctx context.Context, newbin []byte) ([]byte, error) {
+	patch := new(bytes.Buffer)
+	if err := ix.diff(ctx, newbin, patch); err != nil {
+		return nil, err
 	}
-	if err := ioutil.WriteFile(patchfile, diffbytes, 0644); err != nil {
-		return fmt.Errorf("could create patchfile '%v': %v", patchfile, err.Error())
+	return patch.Bytes(), nil
+}
+
+// diff writes a patch from the indexed old file to newbin. The blocks are
+// compressed as they're generated and only written to patch, header first,
+// once the diff is complete.
+func (ix *Index) diff(ctx context.Context, newbin []byte, patch io.Writer) error {
+	return ix.writePatch(ctx, newbin, patch, ix.scanAll)
+}
+
+// scanAll diffs all of newbin against the old file, in parallel if the
+// configuration allows it.
+func (ix *Index) scanAll(ctx context.Context, newbin []byte, out scanOutput) error {
+	if ix.cfg.concurrency > 1 {
+		done, err := ix.scanParallel(ctx, newbin, out)
+		if done || err != nil {
+			return err
+		}
 	}
-	return nil
+	_, err := ix.scan(ctx, newbin, 0, len(newbin), 0, out)
+	return err
 }
 
-func diffb(oldbin, newbin []byte) ([]byte, error) {
+// writePatch writes a patch from the indexed old file to newbin, whose
+// control triples and blocks are generated by calling scan with the
+// filtered newbin.
+func (ix *Index) writePatch(ctx context.Context, newbin []byte, patch io.Writer, scan func(context.Context, []byte, scanOutput) error) error {
+	// scan only checks ctx every progressInterval bytes
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	// File format:
 	// --- header ---
 	//  0     -  7       : "BSDIFF40"
@@ -90,51 +119,190 @@ func diffb(oldbin, newbin []byte) ([]byte, error) {
 	// 64     - 64+X-1   : bzip2(control block)
 	// 64+X   - 64+X+Y-1 : bzip2(diff block)
 	// 64+X+Y - ??       : bzip2(extra block)
+	//
+	// FormatClassic omits the checksum, as upstream bsdiff does, so its
+	// header is 32 bytes long and the blocks start at offset 32.
+	//
+	// FormatExtended records the codec of each block and the checksum of
+	// the new file:
+	// --- header ---
+	//  0     -  7       : "BSDIFFX1"
+	//  8     - 31       : X, Y and len(newfile) as above
+	// 32                : codec of the control block
+	// 33                : codec of the diff block
+	// 34                : codec of the extra block
+	// 35                : checksum algorithm (0 for SHA-256)
+	// 36                : filter applied to both files (0 for none)
+	// 37     - 39       : reserved, zero
+	// 40     - 40+D-1   : checksum(oldfile), D bytes long
+	// 40+D   - 40+2D-1  : checksum(newfile)
+	// ---  data  ---
+	// 40+2D  - ??       : the three blocks as above
 
-	const headerLen = 64
-
-	bziprule := &bzip2.WriterConfig{
-		Level: bzip2.BestCompression,
+	sumLen := ix.cfg.checksum.Size()
+	magic, headerLen := "BSDIFF40", 64
+	switch ix.cfg.format {
+	case FormatClassic:
+		headerLen = 32
+	case FormatExtended:
+		magic, headerLen = "BSDIFFX1", 40+2*sumLen
+	}
+	if ix.cfg.codec != codec.Bzip2 && ix.cfg.format != FormatExtended {
+		return fmt.Errorf("codec %v requires FormatExtended", ix.cfg.codec)
+	}
+	if ix.cfg.checksum != checksum.SHA256 && ix.cfg.format != FormatExtended {
+		return fmt.Errorf("checksum %v requires FormatExtended", ix.cfg.checksum)
+	}
+	if ix.cfg.elfFilter && ix.cfg.format != FormatExtended {
+		return errors.New("ELF filter requires FormatExtended")
+	}
+	if ix.cfg.blockConcurrency > 1 && ix.cfg.format == FormatClassic {
+		return errors.New("block concurrency requires FormatChecksummed or FormatExtended")
+	}
+	comp, err := codec.Get(ix.cfg.codec)
+	if err != nil {
+		return err
 	}
-	iii := make([]int, len(oldbin)+1)
-	qsufsort(iii, oldbin)
-
-	//var db
-	var dblen, eblen int
-
-	// create the patch file
-	pf := new(util.BufWriter)
-	buf := make([]byte, 8)
 
 	newsize := len(newbin)
-	oldsize := len(oldbin)
 
 	// - header
-	// total length is 64, but the checksum (32 bytes) appends to the slice,
-	header := make([]byte, 32, headerLen)
-	copy(header, []byte("BSDIFF40"))
+	header := make([]byte, headerLen)
+	copy(header, []byte(magic))
 	offtout(0, header[8:])
 	offtout(0, header[16:])
 	offtout(newsize, header[24:])
-
-	sum := sha256.New()
-	if _, err := sum.Write(oldbin); err != nil {
-		return nil, err
+	switch ix.cfg.format {
+	case FormatChecksummed:
+		copy(header[32:], ix.oldSum)
+	case FormatExtended:
+		header[32] = byte(ix.cfg.codec)
+		header[33] = byte(ix.cfg.codec)
+		header[34] = byte(ix.cfg.codec)
+		header[35] = byte(ix.cfg.checksum)
+		copy(header[40:], ix.oldSum)
+		newSum, err := ix.cfg.checksum.Sum(newbin)
+		if err != nil {
+			return err
+		}
+		copy(header[40+sumLen:], newSum)
+		// Both checksums are of the files as they are, and the blocks of
+		// the filtered files
+		header[36] = byte(ix.filter)
+		newbin = ix.filter.Encode(newbin)
+	}
+
+	// Each block is compressed into its own buffer, on its own goroutine,
+	// as the differences are computed. The buffers move to temporary files
+	// once they grow large, so only the old file's suffix array stays in
+	// memory.
+	var blocks [3]*spillBuffer
+	var zw [3]*asyncWriter
+	defer func() {
+		for i := range blocks {
+			if zw[i] != nil {
+				zw[i].Close()
+			}
+			if blocks[i] != nil {
+				blocks[i].Close()
+			}
+		}
+	}()
+	for i := range blocks {
+		blocks[i] = newSpillBuffer(ix.cfg.tempDir)
+		var w io.WriteCloser
+		if cc, ok := comp.(codec.ConcurrentCompressor); ok && ix.cfg.blockConcurrency > 1 {
+			w, err = cc.NewConcurrentWriter(blocks[i], ix.cfg.level, ix.cfg.blockConcurrency)
+		} else {
+			w, err = comp.NewWriter(blocks[i], ix.cfg.level)
+		}
+		if err != nil {
+			return err
+		}
+		zw[i] = newAsyncWriter(w)
+	}
+	dbw := bufio.NewWriterSize(zw[1], blockBufferSize)
+	ebw := bufio.NewWriterSize(zw[2], blockBufferSize)
+	out := scanOutput{ctrl: ctrlWriter(zw[0]), db: dbw, eb: ebw}
+	if ix.cfg.progress != nil {
+		out.progress = func(scanned int) {
+			ix.cfg.progress(int64(scanned), int64(newsize))
+		}
+	}
+	if err := scan(ctx, newbin, out); err != nil {
+		return err
+	}
+	if err := dbw.Flush(); err != nil {
+		return err
 	}
-	if sum.Size() != 32 {
-		panic("unexpected: sha256sum size is not 32 bytes")
+	if err := ebw.Flush(); err != nil {
+		return err
+	}
+	// Let the compressors finish their blocks concurrently
+	for _, w := range zw {
+		w.stop()
+	}
+	for i := range zw {
+		err := zw[i].Close()
+		zw[i] = nil
+		if err != nil {
+			return err
+		}
+	}
+	if ix.cfg.progress != nil {
+		ix.cfg.progress(int64(newsize), int64(newsize))
 	}
-	header = sum.Sum(header) // appends to header
 
-	if _, err := pf.Write(header); err != nil {
-		return nil, err
+	// Now that the sizes of the compressed blocks are known, write the
+	// header and the blocks
+	offtout(int(blocks[0].Len()), header[8:])
+	offtout(int(blocks[1].Len()), header[16:])
+	if _, err := patch.Write(header); err != nil {
+		return err
 	}
-	// Compute the differences, writing ctrl as we go
-	pfbz2, err := bzip2.NewWriter(pf, bziprule)
-	if err != nil {
-		return nil, err
+	for _, b := range blocks {
+		if _, err := b.WriteTo(patch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanOutput receives the results of scan.
+type scanOutput struct {
+	// ctrl is passed each control triple.
+	ctrl func(x, y, seek int) error
+	// db and eb receive the diff and extra bytes.
+	db, eb *bufio.Writer
+	// progress, if not nil, is called with the number of bytes scanned.
+	progress func(scanned int)
+}
+
+// ctrlWriter returns a scanOutput.ctrl that writes the triples to w.
+func ctrlWriter(w io.Writer) func(x, y, seek int) error {
+	buf := make([]byte, 24)
+	return func(x, y, seek int) error {
+		offtout(x, buf)
+		offtout(y, buf[8:])
+		offtout(seek, buf[16:])
+		_, err := w.Write(buf)
+		return err
 	}
-	var scan, ln, lastscan, lastpos, lastoffset int
+}
+
+// scan diffs newbin[start:end] against the old file, starting at lastpos in
+// the old file. It returns the old file position reached by the add of the
+// last control triple, before its seek.
+func (ix *Index) scan(ctx context.Context, newbin []byte, start, end, lastpos int, out scanOutput) (int, error) {
+	oldbin := ix.old
+	iii := ix.sa
+	oldsize := len(oldbin)
+	// The scan stops at end rather than at the end of the new file
+	newsize := end
+
+	var ln, oldEnd int
+	scan, lastscan := start, start
+	lastoffset := lastpos - start
 
 	var oldscore, scsc int
 	var pos int
@@ -142,14 +310,7 @@ func diffb(oldbin, newbin []byte) ([]byte, error) {
 	var s, Sf, lenf, Sb, lenb int
 	var overlap, Ss, lens int
 
-	db := make([]byte, newsize+1)
-	eb := make([]byte, newsize+1)
-
-	defer func() {
-		if pfbz2 != nil {
-			pfbz2.Close()
-		}
-	}()
+	lastcheck := start
 
 	for scan < newsize {
 		oldscore = 0
@@ -158,7 +319,16 @@ func diffb(oldbin, newbin []byte) ([]byte, error) {
 		scan += ln
 		scsc = scan
 		for scan < newsize {
-			ln = search(iii, oldbin, newbin[scan:], 0, oldsize, &pos)
+			if scan-lastcheck >= progressInterval {
+				lastcheck = scan
+				if err := ctx.Err(); err != nil {
+					return 0, err
+				}
+				if out.progress != nil {
+					out.progress(scan - start)
+				}
+			}
+			ln = search(iii, oldbin, newbin[scan:end], 0, oldsize, &pos)
 
 			for scsc < scan+ln {
 				if scsc+lastoffset < oldsize && oldbin[scsc+lastoffset] == newbin[scsc] {
@@ -234,100 +404,50 @@ func diffb(oldbin, newbin []byte) ([]byte, error) {
 			}
 
 			for i = 0; i < lenf; i++ {
-				db[dblen+i] = newbin[lastscan+i] - oldbin[lastpos+i]
-			}
-			for i = 0; i < (scan-lenb)-(lastscan+lenf); i++ {
-				eb[eblen+i] = newbin[lastscan+lenf+i]
-			}
-
-			dblen += lenf
-			eblen += (scan - lenb) - (lastscan + lenf)
-
-			offtout(lenf, buf)
-			if _, err := pfbz2.Write(buf); err != nil {
-				return nil, err
+				if err := out.db.WriteByte(newbin[lastscan+i] - oldbin[lastpos+i]); err != nil {
+					return 0, err
+				}
 			}
-
-			offtout((scan-lenb)-(lastscan+lenf), buf)
-			if _, err := pfbz2.Write(buf); err != nil {
-				return nil, err
+			if lastscan+lenf < scan-lenb {
+				if _, err := out.eb.Write(newbin[lastscan+lenf : scan-lenb]); err != nil {
+					return 0, err
+				}
 			}
 
-			offtout((pos-lenb)-(lastpos+lenf), buf)
-			if _, err := pfbz2.Write(buf); err != nil {
-				return nil, err
+			if err := out.ctrl(lenf, (scan-lenb)-(lastscan+lenf), (pos-lenb)-(lastpos+lenf)); err != nil {
+				return 0, err
 			}
+			oldEnd = lastpos + lenf
 
 			lastscan = scan - lenb
 			lastpos = pos - lenb
 			lastoffset = pos - scan
 		}
 	}
-	if err = pfbz2.Close(); err != nil {
-		return nil, err
-	}
-
-	// Compute size of compressed ctrl data
-	ln = pf.Len()
-	offtout(ln-headerLen, header[8:])
-
-	// Write compressed diff data
-	pfbz2, err = bzip2.NewWriter(pf, bziprule)
-	if err != nil {
-		return nil, err
-	}
-	if _, err = pfbz2.Write(db[:dblen]); err != nil {
-		return nil, err
-	}
-
-	if err = pfbz2.Close(); err != nil {
-		return nil, err
-	}
-	// Compute size of compressed diff data
-	newsize = pf.Len()
-	offtout(newsize-ln, header[16:])
-	// Write compressed extra data
-	pfbz2, err = bzip2.NewWriter(pf, bziprule)
-	if err != nil {
-		return nil, err
-	}
-	if _, err = pfbz2.Write(eb[:eblen]); err != nil {
-		return nil, err
-	}
-	if err = pfbz2.Close(); err != nil {
-		return nil, err
-	}
-	// Seek to the beginning, write the header, and close the file
-	if _, err = pf.Seek(0, io.SeekStart); err != nil {
-		return nil, err
-	}
-	if _, err = pf.Write(header); err != nil {
-		return nil, err
-	}
-
-	return pf.Bytes(), nil
+	return oldEnd, nil
 }
 
-func search(iii []int, oldbin []byte, newbin []byte, st, en int, pos *int) int {
+func search(iii suffixArray, oldbin []byte, newbin []byte, st, en int, pos *int) int {
 	var x, y int
 	oldsize := len(oldbin)
 	newsize := len(newbin)
 
 	if en-st < 2 {
-		x = matchlen(oldbin[iii[st]:], newbin)
-		y = matchlen(oldbin[iii[en]:], newbin)
+		x = matchlen(oldbin[iii.at(st):], newbin)
+		y = matchlen(oldbin[iii.at(en):], newbin)
 
 		if x > y {
-			*pos = iii[st]
+			*pos = iii.at(st)
 			return x
 		}
-		*pos = iii[en]
+		*pos = iii.at(en)
 		return y
 	}
 
 	x = st + (en-st)/2
-	cmpln := util.Min(oldsize-iii[x], newsize)
-	if bytes.Compare(oldbin[iii[x]:iii[x]+cmpln], newbin[:cmpln]) < 0 {
+	ix := iii.at(x)
+	cmpln := util.Min(oldsize-ix, newsize)
+	if bytes.Compare(oldbin[ix:ix+cmpln], newbin[:cmpln]) < 0 {
 		return search(iii, oldbin, newbin, x, en, pos)
 	}
 	return search(iii, oldbin, newbin, st, x, pos)
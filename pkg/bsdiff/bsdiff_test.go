@@ -2,14 +2,24 @@ package bsdiff
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
 	"testing"
 	"time"
 
+	"github.com/kiteco/go-bsdiff/v2/pkg/bspatch"
+	"github.com/kiteco/go-bsdiff/v2/pkg/checksum"
+	"github.com/kiteco/go-bsdiff/v2/pkg/codec"
+	"github.com/kiteco/go-bsdiff/v2/pkg/filter"
 	"github.com/kiteco/go-bsdiff/v2/pkg/util"
 )
 
@@ -140,3 +150,443 @@ func TestFile(t *testing.T) {
 	os.Remove(t1n)
 	os.Remove(tpp)
 }
+
+func TestClassic(t *testing.T) {
+	oldbs := []byte("the quick brown fox jumps over the lazy dog")
+	newbs := []byte("the quick brown cat jumps over the lazy dog!")
+	patch, err := Bytes(oldbs, newbs, WithFormat(FormatClassic))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(patch[32:35], []byte("BZh")) {
+		t.Fatal("classic patch blocks should start at offset 32")
+	}
+	newbs2, err := bspatch.Bytes(oldbs, patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(newbs, newbs2) {
+		t.Fatal(newbs2, "!=", newbs)
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	oldbs := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog "), 50)
+	newbs := bytes.Replace(oldbs, []byte("fox"), []byte("cat"), 7)
+	for _, id := range []codec.ID{codec.None, codec.Bzip2, codec.Gzip, codec.Zstd, codec.XZ, codec.Brotli} {
+		patch, err := Bytes(oldbs, newbs, WithFormat(FormatExtended), WithCodec(id))
+		if err != nil {
+			t.Fatal(id, err)
+		}
+		if !bytes.Equal(patch[:8], []byte("BSDIFFX1")) || patch[32] != byte(id) {
+			t.Fatal(id, "unexpected header", patch[:40])
+		}
+		newbs2, err := bspatch.Bytes(oldbs, patch)
+		if err != nil {
+			t.Fatal(id, err)
+		}
+		if !bytes.Equal(newbs, newbs2) {
+			t.Fatal(id, newbs2, "!=", newbs)
+		}
+		if _, err := bspatch.Bytes(oldbs, patch[:len(patch)-1]); !errors.Is(err, bspatch.ErrTruncated) {
+			t.Fatal(id, "expected ErrTruncated, got", err)
+		}
+	}
+	if _, err := Bytes(oldbs, newbs, WithCodec(codec.Zstd)); err == nil {
+		t.Fatal("zstd should require FormatExtended")
+	}
+}
+
+func TestChecksums(t *testing.T) {
+	oldbs := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog "), 50)
+	newbs := bytes.Replace(oldbs, []byte("fox"), []byte("cat"), 7)
+	for _, alg := range []checksum.Algorithm{checksum.SHA256, checksum.SHA512, checksum.CRC32C} {
+		d := New(WithFormat(FormatExtended), WithChecksum(alg), WithLevel(codec.BestSpeed))
+		patch, err := d.Bytes(oldbs, newbs)
+		if err != nil {
+			t.Fatal(alg, err)
+		}
+		if patch[35] != byte(alg) {
+			t.Fatal(alg, "unexpected header", patch[:40])
+		}
+		newbs2, err := bspatch.New().Bytes(oldbs, patch)
+		if err != nil {
+			t.Fatal(alg, err)
+		}
+		if !bytes.Equal(newbs, newbs2) {
+			t.Fatal(alg, newbs2, "!=", newbs)
+		}
+		// A different old file must fail the old file's checksum
+		if _, err := bspatch.Bytes(newbs, patch); err == nil {
+			t.Fatal(alg, "patch applied to the wrong old file")
+		}
+	}
+	if _, err := Bytes(oldbs, newbs, WithChecksum(checksum.SHA512)); err == nil {
+		t.Fatal("SHA-512 should require FormatExtended")
+	}
+}
+
+func TestDiffContext(t *testing.T) {
+	rnd := rand.New(rand.NewSource(4))
+	file1 := make([]byte, 1024*64)
+	file2 := make([]byte, 1024*300)
+	rnd.Read(file1)
+	rnd.Read(file2)
+	copy(file2, file1)
+
+	var calls int
+	var last int64
+	progress := func(done, total int64) {
+		calls++
+		if done < last || total != int64(len(file2)) {
+			t.Errorf("unexpected progress %v/%v", done, total)
+		}
+		last = done
+	}
+	patch := new(bytes.Buffer)
+	if err := DiffContext(context.Background(), file1, file2, patch, WithProgress(progress)); err != nil {
+		t.Fatal(err)
+	}
+	if calls < 2 || last != int64(len(file2)) {
+		t.Fatalf("progress not reported to the end (%v calls, last %v)", calls, last)
+	}
+	expected, err := Bytes(file1, file2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(patch.Bytes(), expected) {
+		t.Fatal("DiffContext and Bytes patches differ")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := DiffContext(ctx, file1, file2, new(bytes.Buffer)); err != context.Canceled {
+		t.Fatal("expected context.Canceled, got", err)
+	}
+	// Inputs smaller than progressInterval are cancelled too, including
+	// while the old file is sorted
+	if err := DiffContext(ctx, file1[:100], file2[:100], new(bytes.Buffer)); err != context.Canceled {
+		t.Fatal("small input: expected context.Canceled, got", err)
+	}
+	if err := DiffContext(&cancelAfterCtx{Context: context.Background(), n: 1}, file1[:100], file2[:100], new(bytes.Buffer)); err != context.Canceled {
+		t.Fatal("cancelled while sorting: expected context.Canceled, got", err)
+	}
+}
+
+// cancelAfterCtx is a context that is cancelled once Err has been called n
+// times.
+type cancelAfterCtx struct {
+	context.Context
+	n int
+}
+
+func (c *cancelAfterCtx) Err() error {
+	if c.n > 0 {
+		c.n--
+		return nil
+	}
+	return context.Canceled
+}
+
+func TestMemoryLimit(t *testing.T) {
+	file1 := bytes.Repeat([]byte("abcdefgh"), 1024)
+	file2 := bytes.Repeat([]byte("abcdefgi"), 1024)
+	d := New(WithMemoryLimit(1024))
+	if _, err := d.Bytes(file1, file2); err != ErrMemoryLimit {
+		t.Fatal("expected ErrMemoryLimit, got", err)
+	}
+	d = New(WithMemoryLimit(64 << 20))
+	patch, err := d.Bytes(file1, file2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := Bytes(file1, file2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(patch, expected) {
+		t.Fatal("patches differ with a memory limit")
+	}
+
+	dir := t.TempDir()
+	oldfile, newfile := filepath.Join(dir, "old"), filepath.Join(dir, "new")
+	if err := ioutil.WriteFile(oldfile, file1, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(newfile, file2, 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = New(WithMemoryLimit(1024)).File(oldfile, newfile, filepath.Join(dir, "patch"))
+	if !errors.Is(err, ErrMemoryLimit) {
+		t.Fatal("expected ErrMemoryLimit from File, got", err)
+	}
+	if err := File(filepath.Join(dir, "missing"), newfile, filepath.Join(dir, "patch")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("expected os.ErrNotExist, got", err)
+	}
+}
+
+func TestMapFile(t *testing.T) {
+	dir := t.TempDir()
+	for _, content := range []string{"mapped where possible", ""} {
+		name := filepath.Join(dir, "file")
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		b, mapped, unmap, err := mapFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != content {
+			t.Errorf("mapFile read %q, want %q", b, content)
+		}
+		// Empty files can't be mapped, and count as read into memory
+		if want := runtime.GOOS == "linux" && content != ""; mapped != want {
+			t.Errorf("%q: mapped is %v, want %v", content, mapped, want)
+		}
+		if err := unmap(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFileMatchesBytes(t *testing.T) {
+	rnd := rand.New(rand.NewSource(5))
+	file1 := make([]byte, 1024*64)
+	file2 := make([]byte, 1024*70)
+	rnd.Read(file1)
+	copy(file2, file1)
+	rnd.Read(file2[1024*60:])
+
+	dir, err := ioutil.TempDir("", "bsdiff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "tmp")
+	if err := os.Mkdir(tmp, 0755); err != nil {
+		t.Fatal(err)
+	}
+	oldfile := filepath.Join(dir, "old")
+	newfile := filepath.Join(dir, "new")
+	patchfile := filepath.Join(dir, "patch")
+	if err := ioutil.WriteFile(oldfile, file1, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(newfile, file2, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := File(oldfile, newfile, patchfile, WithTempDir(tmp)); err != nil {
+		t.Fatal(err)
+	}
+	patch, err := ioutil.ReadFile(patchfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := Bytes(file1, file2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(patch, expected) {
+		t.Fatal("File and Bytes patches differ")
+	}
+	if tmps, _ := ioutil.ReadDir(tmp); len(tmps) != 0 {
+		t.Fatal("temporary files were left behind")
+	}
+}
+
+func TestSpillBuffer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bsdiff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sb := &spillBuffer{dir: dir, limit: 16}
+	var expected []byte
+	for i := 0; i < 10; i++ {
+		p := bytes.Repeat([]byte{byte(i)}, i+1)
+		if _, err := sb.Write(p); err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, p...)
+	}
+	if sb.f == nil {
+		t.Fatal("buffer did not spill to a file")
+	}
+	if sb.Len() != int64(len(expected)) {
+		t.Fatalf("Len() = %v, want %v", sb.Len(), len(expected))
+	}
+	out := new(bytes.Buffer)
+	if _, err := sb.WriteTo(out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), expected) {
+		t.Fatal("spilled contents differ")
+	}
+	if err := sb.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if tmps, _ := ioutil.ReadDir(dir); len(tmps) != 0 {
+		t.Fatal("temporary file was not removed")
+	}
+}
+
+// elfBenchProgram is built in two versions for BenchmarkELFFilter. The
+// second one links another package, which moves the code linked after it.
+const elfBenchProgram = `package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	%s
+)
+
+func main() {
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, %s)
+	})
+	if len(os.Args) > 1 {
+		http.ListenAndServe(os.Args[1], nil)
+	}
+}
+`
+
+// buildELFBenchProgram builds a version of elfBenchProgram and returns the
+// binary.
+func buildELFBenchProgram(b *testing.B, imports, message string) []byte {
+	dir := b.TempDir()
+	src := filepath.Join(dir, "main.go")
+	if err := ioutil.WriteFile(src, []byte(fmt.Sprintf(elfBenchProgram, imports, message)), 0644); err != nil {
+		b.Fatal(err)
+	}
+	exe := filepath.Join(dir, "prog")
+	// Stripped, as releases usually are; the compressed DWARF sections would
+	// otherwise make up most of the patch
+	cmd := exec.Command("go", "build", "-ldflags=-s -w", "-o", exe, src)
+	cmd.Env = append(os.Environ(), "CGO_ENABLED=0", "GOOS=linux")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		b.Skipf("could not build test program: %v\n%s", err, out)
+	}
+	bin, err := ioutil.ReadFile(exe)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return bin
+}
+
+// BenchmarkELFFilter diffs two builds of a Go program with and without the
+// ELF filter and reports the patch sizes.
+func BenchmarkELFFilter(b *testing.B) {
+	oldbs := buildELFBenchProgram(b, "", `"v1"`)
+	newbs := buildELFBenchProgram(b, `"sort"`, `sort.IsSorted(nil)`)
+	for _, filtered := range []bool{false, true} {
+		name := "plain"
+		if filtered {
+			name = "elf"
+		}
+		b.Run(name, func(b *testing.B) {
+			d := New(WithFormat(FormatExtended), WithELFFilter(filtered))
+			b.SetBytes(int64(len(newbs)))
+			var size int
+			for i := 0; i < b.N; i++ {
+				patch, err := d.Bytes(oldbs, newbs)
+				if err != nil {
+					b.Fatal(err)
+				}
+				size = len(patch)
+			}
+			b.ReportMetric(float64(size), "patch-bytes")
+		})
+	}
+}
+
+// makeExecutable returns an x86-64 ELF file whose code calls or jumps to
+// functions in its first 4 KiB every few bytes. extra is inserted in the
+// middle of the code, moving the branches after it but not their targets.
+func makeExecutable(extra []byte) []byte {
+	const hdrLen = 64 + 56
+	b := make([]byte, hdrLen)
+	copy(b, "\x7fELF\x02\x01\x01")
+	binary.LittleEndian.PutUint16(b[16:], 2)
+	binary.LittleEndian.PutUint16(b[18:], 62)
+	binary.LittleEndian.PutUint64(b[32:], 64)
+	binary.LittleEndian.PutUint16(b[54:], 56)
+	binary.LittleEndian.PutUint16(b[56:], 1)
+	binary.LittleEndian.PutUint32(b[64:], 1)
+	binary.LittleEndian.PutUint32(b[68:], 5)
+	binary.LittleEndian.PutUint64(b[80:], 0x400000)
+	rnd := rand.New(rand.NewSource(1))
+	b = append(b, make([]byte, 4096)...)
+	rnd.Read(b[hdrLen:])
+	for len(b) < 1<<20 {
+		if len(b) >= 1<<19 && extra != nil {
+			b = append(b, extra...)
+			extra = nil
+		}
+		for i := rnd.Intn(8); i > 0; i-- {
+			b = append(b, byte(rnd.Intn(0xE8)))
+		}
+		target := hdrLen + rnd.Intn(64)*64
+		b = append(b, 0xE8+byte(rnd.Intn(2)))
+		b = binary.LittleEndian.AppendUint32(b, uint32(target-len(b)-4))
+	}
+	binary.LittleEndian.PutUint64(b[96:], uint64(len(b)))
+	return b
+}
+
+func TestELFFilter(t *testing.T) {
+	oldbs := makeExecutable(nil)
+	newbs := makeExecutable([]byte("inserted code"))
+	d := New(WithFormat(FormatExtended), WithELFFilter(true))
+	patch, err := d.Bytes(oldbs, newbs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := Bytes(oldbs, newbs, WithFormat(FormatExtended))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(patch) >= len(raw)/2 {
+		t.Error("filtered patch is", len(patch), "bytes, unfiltered patch", len(raw))
+	}
+	info, err := bspatch.Inspect(bytes.NewReader(patch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Filter != filter.X86_64 {
+		t.Error("patch records filter", info.Filter)
+	}
+	newbs2, err := bspatch.Bytes(oldbs, patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(newbs, newbs2) {
+		t.Fatal("filtered patch does not reproduce the new file")
+	}
+	var out bytes.Buffer
+	if err := bspatch.Apply(bytes.NewReader(oldbs), &out, bytes.NewReader(patch), bspatch.WithCopyBufferSize(7)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(newbs, out.Bytes()) {
+		t.Fatal("streamed filtered patch does not reproduce the new file")
+	}
+	limit := bspatch.WithMemoryLimit(2*int64(len(oldbs)) - 1)
+	if err := bspatch.Apply(bytes.NewReader(oldbs), ioutil.Discard, bytes.NewReader(patch), limit); !errors.Is(err, bspatch.ErrMemoryLimit) {
+		t.Fatal("expected ErrMemoryLimit, got", err)
+	}
+
+	// Files that aren't executables are diffed as usual
+	patch, err = d.Bytes([]byte("old text"), []byte("new text"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if patch[36] != 0 {
+		t.Error("text file filtered with filter", patch[36])
+	}
+
+	if _, err := Bytes(oldbs, newbs, WithELFFilter(true)); err == nil {
+		t.Error("expected the ELF filter to require FormatExtended")
+	}
+}
@@ -0,0 +1,107 @@
+package bsdiff
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Differ generates patches with a fixed set of options. A Differ is safe
+// for concurrent use by multiple goroutines.
+type Differ struct {
+	cfg *config
+}
+
+// New returns a Differ configured by opts.
+func New(opts ...Option) *Differ {
+	return &Differ{newConfig(opts)}
+}
+
+// Bytes takes the old and new byte slices and outputs the diff
+func (d *Differ) Bytes(oldbs, newbs []byte) ([]byte, error) {
+	return diffb(context.Background(), oldbs, newbs, d.cfg)
+}
+
+// DiffContext writes the diff of oldbs and newbs to patchf. It returns
+// ctx.Err() if ctx is done before the diff is complete.
+func (d *Differ) DiffContext(ctx context.Context, oldbs, newbs []byte, patchf io.Writer) error {
+	if err := d.cfg.checkMemory(len(oldbs), int64(len(oldbs))+int64(len(newbs))); err != nil {
+		return err
+	}
+	// Sorting the old file can take a while, so ctx is checked before and
+	// after it as well as while scanning
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return newIndex(oldbs, d.cfg).diff(ctx, newbs, patchf)
+}
+
+// Reader takes the old and new binaries and outputs to a stream of the diff file
+func (d *Differ) Reader(oldbin io.Reader, newbin io.Reader, patchf io.Writer) error {
+	oldbs, err := ioutil.ReadAll(oldbin)
+	if err != nil {
+		return err
+	}
+	newbs, err := ioutil.ReadAll(newbin)
+	if err != nil {
+		return err
+	}
+	return d.DiffContext(context.Background(), oldbs, newbs, patchf)
+}
+
+// File reads the old and new files to create a diff patch file. On Linux
+// both files are memory mapped, and large blocks of the patch are held in
+// temporary files until it is written, so the heap holds little more than
+// the suffix array of the old file. Elsewhere, or if a file can't be
+// mapped, it is read into memory and counts toward WithMemoryLimit.
+func (d *Differ) File(oldfile, newfile, patchfile string) error {
+	oldbs, oldMapped, unmapOld, err := mapFile(oldfile)
+	if err != nil {
+		return fmt.Errorf("could not read oldfile '%v': %w", oldfile, err)
+	}
+	defer unmapOld()
+	newbs, newMapped, unmapNew, err := mapFile(newfile)
+	if err != nil {
+		return fmt.Errorf("could not read newfile '%v': %w", newfile, err)
+	}
+	defer unmapNew()
+	if err := d.cfg.checkMemory(len(oldbs), heapSize(oldbs, oldMapped)+heapSize(newbs, newMapped)); err != nil {
+		return fmt.Errorf("bsdiff: %w", err)
+	}
+
+	pf, err := os.Create(patchfile)
+	if err != nil {
+		return fmt.Errorf("could create patchfile '%v': %w", patchfile, err)
+	}
+	pw := bufio.NewWriter(pf)
+	err = newIndex(oldbs, d.cfg).diff(context.Background(), newbs, pw)
+	if err == nil {
+		err = pw.Flush()
+	}
+	if cerr := pf.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(patchfile)
+		return fmt.Errorf("bsdiff: %w", err)
+	}
+	return nil
+}
+
+// heapSize returns the size of b, as returned by mapFile, if it is on the
+// heap.
+func heapSize(b []byte, mapped bool) int64 {
+	if mapped {
+		return 0
+	}
+	return int64(len(b))
+}
+
+// NewIndex sorts the suffixes of oldbs so it can be diffed against many new
+// files with the Differ's options.
+func (d *Differ) NewIndex(oldbs []byte) *Index {
+	return newIndex(oldbs, d.cfg)
+}
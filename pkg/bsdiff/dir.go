@@ -0,0 +1,297 @@
+package bsdiff
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Tree patch entry operations and kinds. They are stored in tree patches,
+// so they must never change.
+const (
+	dirAdded     = 1
+	dirRemoved   = 2
+	dirRenamed   = 3
+	dirModified  = 4
+	dirUnchanged = 5
+
+	kindFile    = 0
+	kindDir     = 1
+	kindSymlink = 2
+)
+
+// unixMode returns the permission, setuid, setgid and sticky bits of m as
+// in a Unix file mode, which is how tree patches record them.
+func unixMode(m os.FileMode) uint32 {
+	mode := uint32(m & os.ModePerm)
+	if m&os.ModeSetuid != 0 {
+		mode |= 04000
+	}
+	if m&os.ModeSetgid != 0 {
+		mode |= 02000
+	}
+	if m&os.ModeSticky != 0 {
+		mode |= 01000
+	}
+	return mode
+}
+
+// treeFile is a file, directory or symlink of a tree.
+type treeFile struct {
+	kind   byte
+	mode   uint32
+	target string
+	size   int64
+	sum    [sha256.Size]byte
+}
+
+// treeEntry is one entry of a tree patch's manifest.
+type treeEntry struct {
+	op     byte
+	path   string
+	source string
+	*treeFile
+}
+
+// walkTree lists the files below root by slash-separated path, in lexical
+// order. Regular files are hashed.
+func walkTree(root string) (map[string]*treeFile, []string, error) {
+	files := map[string]*treeFile{}
+	var paths []string
+	err := filepath.Walk(root, func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, name)
+		if err != nil || rel == "." {
+			return err
+		}
+		f := &treeFile{mode: unixMode(fi.Mode())}
+		switch {
+		case fi.Mode().IsRegular():
+			f.kind, f.size = kindFile, fi.Size()
+			if f.sum, err = hashFile(name); err != nil {
+				return err
+			}
+		case fi.IsDir():
+			f.kind = kindDir
+		case fi.Mode()&os.ModeSymlink != 0:
+			f.kind = kindSymlink
+			if f.target, err = os.Readlink(name); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%v: unsupported file type %v", name, fi.Mode().Type())
+		}
+		rel = filepath.ToSlash(rel)
+		files[rel] = f
+		paths = append(paths, rel)
+		return nil
+	})
+	return files, paths, err
+}
+
+func hashFile(name string) (sum [sha256.Size]byte, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return sum, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+// treeManifest matches the files of the new tree with those of the old one.
+// Files are matched by path, then by content so that renamed files are
+// found.
+func treeManifest(oldFiles map[string]*treeFile, oldPaths []string, newFiles map[string]*treeFile, newPaths []string) []treeEntry {
+	// Old files by content, preferring those removed from the new tree
+	bySum := map[[sha256.Size]byte]string{}
+	for _, p := range oldPaths {
+		f := oldFiles[p]
+		if f.kind != kindFile {
+			continue
+		}
+		if prev, ok := bySum[f.sum]; !ok || newFiles[prev] != nil && newFiles[p] == nil {
+			bySum[f.sum] = p
+		}
+	}
+
+	var entries []treeEntry
+	for _, p := range newPaths {
+		f := newFiles[p]
+		e := treeEntry{op: dirAdded, path: p, treeFile: f}
+		old := oldFiles[p]
+		switch {
+		case old != nil && old.kind == f.kind && f.kind == kindFile:
+			e.source = p
+			if old.sum == f.sum {
+				e.op = dirUnchanged
+			} else if src, ok := bySum[f.sum]; ok {
+				e.op, e.source = dirRenamed, src
+			} else {
+				e.op = dirModified
+			}
+		case old != nil && old.kind == f.kind && f.kind == kindDir:
+			e.op = dirUnchanged
+		case old != nil && old.kind == f.kind && f.kind == kindSymlink:
+			e.op = dirModified
+			if old.target == f.target {
+				e.op = dirUnchanged
+			}
+		case f.kind == kindFile:
+			if src, ok := bySum[f.sum]; ok {
+				e.op, e.source = dirRenamed, src
+			}
+		}
+		entries = append(entries, e)
+	}
+	for _, p := range oldPaths {
+		if newFiles[p] == nil {
+			entries = append(entries, treeEntry{op: dirRemoved, path: p, treeFile: &treeFile{kind: oldFiles[p].kind}})
+		}
+	}
+	return entries
+}
+
+type treeWriter struct {
+	w   *bufio.Writer
+	buf [binary.MaxVarintLen64]byte
+	err error
+}
+
+func (tw *treeWriter) write(p []byte) {
+	if tw.err == nil {
+		_, tw.err = tw.w.Write(p)
+	}
+}
+
+func (tw *treeWriter) uvarint(x uint64) {
+	tw.write(tw.buf[:binary.PutUvarint(tw.buf[:], x)])
+}
+
+func (tw *treeWriter) string(s string) {
+	tw.uvarint(uint64(len(s)))
+	tw.write([]byte(s))
+}
+
+// Dir writes a patch that turns the tree below oldDir into the one below
+// newDir. See Differ.Dir.
+func Dir(oldDir, newDir string, patch io.Writer, opts ...Option) error {
+	return New(opts...).Dir(oldDir, newDir, patch)
+}
+
+// Dir writes a patch that turns the tree below oldDir into the one below
+// newDir, to be applied with bspatch.Dir. It records added, removed,
+// renamed, modified and unchanged files, directories and symlinks with
+// their permissions. Modified and added files are stored as bsdiff patches
+// generated with the Differ's options. Symlinks are not followed.
+func (d *Differ) Dir(oldDir, newDir string, patch io.Writer) error {
+	// Tree patch format:
+	// --- header ---
+	// 0 - 7 : "BSDIFFD1"
+	// uvarint: number of entries
+	// --- manifest ---
+	// For each entry, with every integer a uvarint and every string its
+	// uvarint length and bytes:
+	//   op     : 1 byte, added, removed, renamed, modified or unchanged
+	//   kind   : 1 byte, file, directory or symlink
+	//   mode   : permission, setuid, setgid and sticky bits
+	//   path   : slash-separated path below the tree's root
+	//   source : path of the old file for renamed, modified or unchanged
+	//            files
+	//   target : target of symlinks
+	//   size   : size of files
+	//   sum    : 32 bytes, the SHA-256 of files
+	// Entries of the new tree are in the order of a walk with the contents
+	// of each directory sorted by name, so directories come before their
+	// contents. Removed entries come last.
+	// ---  data  ---
+	// For each added or modified file, in manifest order, the uvarint
+	// length of a bsdiff patch from the source (or an empty file) and the
+	// patch itself.
+	oldFiles, oldPaths, err := walkTree(oldDir)
+	if err != nil {
+		return fmt.Errorf("bsdiff: %w", err)
+	}
+	newFiles, newPaths, err := walkTree(newDir)
+	if err != nil {
+		return fmt.Errorf("bsdiff: %w", err)
+	}
+	entries := treeManifest(oldFiles, oldPaths, newFiles, newPaths)
+
+	tw := &treeWriter{w: bufio.NewWriter(patch)}
+	tw.write([]byte("BSDIFFD1"))
+	tw.uvarint(uint64(len(entries)))
+	for _, e := range entries {
+		tw.write([]byte{e.op, e.kind})
+		tw.uvarint(uint64(e.mode))
+		tw.string(e.path)
+		tw.string(e.source)
+		tw.string(e.target)
+		tw.uvarint(uint64(e.size))
+		tw.write(e.sum[:])
+	}
+	for _, e := range entries {
+		if e.kind != kindFile || e.op != dirAdded && e.op != dirModified {
+			continue
+		}
+		if err := d.treeFile(tw, oldDir, newDir, e); err != nil {
+			return fmt.Errorf("bsdiff: %v: %w", e.path, err)
+		}
+	}
+	if tw.err == nil {
+		tw.err = tw.w.Flush()
+	}
+	if tw.err != nil {
+		return fmt.Errorf("bsdiff: %w", tw.err)
+	}
+	return nil
+}
+
+// treeFile writes the patch of an added or modified file.
+func (d *Differ) treeFile(tw *treeWriter, oldDir, newDir string, e treeEntry) error {
+	var oldbs []byte
+	var oldMapped bool
+	if e.op == dirModified {
+		var unmap func() error
+		var err error
+		if oldbs, oldMapped, unmap, err = mapFile(filepath.Join(oldDir, filepath.FromSlash(e.source))); err != nil {
+			return err
+		}
+		defer unmap()
+	}
+	newbs, newMapped, unmap, err := mapFile(filepath.Join(newDir, filepath.FromSlash(e.path)))
+	if err != nil {
+		return err
+	}
+	defer unmap()
+	if int64(len(newbs)) != e.size {
+		return errors.New("file changed while diffing")
+	}
+	if err := d.cfg.checkMemory(len(oldbs), heapSize(oldbs, oldMapped)+heapSize(newbs, newMapped)); err != nil {
+		return err
+	}
+
+	// The patch's length comes before it, so hold it until it is complete
+	buf := newSpillBuffer(d.cfg.tempDir)
+	defer buf.Close()
+	if err := newIndex(oldbs, d.cfg).diff(context.Background(), newbs, buf); err != nil {
+		return err
+	}
+	tw.uvarint(uint64(buf.Len()))
+	if tw.err == nil {
+		_, tw.err = buf.WriteTo(tw.w)
+	}
+	return tw.err
+}
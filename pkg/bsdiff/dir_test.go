@@ -0,0 +1,140 @@
+package bsdiff
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kiteco/go-bsdiff/v2/pkg/bspatch"
+	"github.com/kiteco/go-bsdiff/v2/pkg/codec"
+)
+
+// writeTree creates files below dir from a map of slash-separated paths to
+// contents. Paths ending in "/" are directories and contents starting with
+// "->" are symlink targets.
+func writeTree(t *testing.T, dir string, files map[string]string) {
+	for p, content := range files {
+		name := filepath.Join(dir, filepath.FromSlash(p))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		var err error
+		switch {
+		case strings.HasSuffix(p, "/"):
+			err = os.MkdirAll(name, 0755)
+		case strings.HasPrefix(content, "->"):
+			err = os.Symlink(content[2:], name)
+		default:
+			err = ioutil.WriteFile(name, []byte(content), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readTree lists the tree below dir in the form taken by writeTree, with
+// the permissions of files and directories.
+func readTree(t *testing.T, dir string) map[string]string {
+	files := map[string]string{}
+	err := filepath.Walk(dir, func(name string, fi os.FileInfo, err error) error {
+		if err != nil || name == dir {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, name)
+		rel = filepath.ToSlash(rel)
+		switch {
+		case fi.IsDir():
+			files[rel+"/"] = fi.Mode().Perm().String()
+		case fi.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(name)
+			files[rel] = "->" + target
+			return err
+		default:
+			content, err := ioutil.ReadFile(name)
+			files[rel] = fi.Mode().Perm().String() + " " + string(content)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bsdiff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	olddir := filepath.Join(dir, "old")
+	newdir := filepath.Join(dir, "new")
+	outdir := filepath.Join(dir, "out")
+	lorem := strings.Repeat("lorem ipsum dolor sit amet ", 100)
+	writeTree(t, olddir, map[string]string{
+		"modified.txt":    lorem,
+		"unchanged.txt":   "unchanged",
+		"renamed.txt":     "renamed " + lorem,
+		"removed/file":    "removed",
+		"link":            "->modified.txt",
+		"retargeted":      "->unchanged.txt",
+		"script.sh":       "#!/bin/sh\n",
+		"dir/nested.txt":  "nested",
+		"empty/":          "",
+		"kind-changed":    "was a file",
+		"dir/duplicate-a": "duplicate",
+	})
+	writeTree(t, newdir, map[string]string{
+		"modified.txt":       strings.Replace(lorem, "dolor", "color", 3),
+		"unchanged.txt":      "unchanged",
+		"moved/renamed.txt":  "renamed " + lorem,
+		"link":               "->modified.txt",
+		"retargeted":         "->moved/renamed.txt",
+		"script.sh":          "#!/bin/sh\n",
+		"dir/nested.txt":     "nested",
+		"dir/added.txt":      "added",
+		"empty/":             "",
+		"kind-changed/":      "",
+		"dir/duplicate-a":    "duplicate",
+		"dir/duplicate-b":    "duplicate",
+		"added/deep/file.go": "package deep\n",
+	})
+	if err := os.Chmod(filepath.Join(newdir, "script.sh"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(newdir, "dir"), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	patch := new(bytes.Buffer)
+	if err := Dir(olddir, newdir, patch, WithFormat(FormatExtended), WithCodec(codec.Zstd)); err != nil {
+		t.Fatal(err)
+	}
+	if patch.Len() >= len(lorem) {
+		t.Fatal("renamed file was not detected, patch is", patch.Len(), "bytes")
+	}
+	if err := bspatch.Dir(olddir, outdir, bytes.NewReader(patch.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	expected, actual := readTree(t, newdir), readTree(t, outdir)
+	for p, content := range expected {
+		if actual[p] != content {
+			t.Errorf("%s: expected %q, got %q", p, content, actual[p])
+		}
+	}
+	for p := range actual {
+		if _, ok := expected[p]; !ok {
+			t.Errorf("%s should not exist", p)
+		}
+	}
+
+	if err := Dir(filepath.Join(dir, "missing"), newdir, ioutil.Discard); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("expected os.ErrNotExist, got", err)
+	}
+}
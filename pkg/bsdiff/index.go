@@ -0,0 +1,215 @@
+package bsdiff
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/kiteco/go-bsdiff/v2/pkg/filter"
+)
+
+const (
+	// Index file format:
+	// --- header ---
+	//  0 -  7 : "BSDIFFIX"
+	//  8      : format version (1)
+	//  9      : bytes per suffix array entry (4 or 8)
+	// 10 - 15 : reserved, zero
+	// 16 - 23 : len(oldfile)
+	// 24 - 55 : sha256sum(oldfile)
+	// ---  data  ---
+	// 56 - ?? : len(oldfile)+1 little endian suffix array entries
+
+	indexMagic     = "BSDIFFIX"
+	indexVersion   = 1
+	indexHeaderLen = 56
+)
+
+// ErrIndexMismatch is returned by ReadIndex when the stored index was not
+// built from the given old file.
+var ErrIndexMismatch = errors.New("bsdiff: index does not match oldfile")
+
+// Index is the suffix-sorted form of an old file. Building it is the most
+// expensive part of a diff, so an Index can be reused to diff any number of
+// new files against the same old file, and saved to disk with WriteTo.
+//
+// An Index is safe for concurrent use by multiple goroutines.
+type Index struct {
+	old []byte
+	sa  suffixArray
+	// oldSum is the checksum of the old file with the configured
+	// algorithm, before filtering.
+	oldSum []byte
+	// filter is the filter applied to old and to new files.
+	filter filter.ID
+	cfg    *config
+}
+
+// NewIndex sorts the suffixes of oldbs. oldbs must not be modified while the
+// Index is in use.
+func NewIndex(oldbs []byte, opts ...Option) *Index {
+	return newIndex(oldbs, newConfig(opts))
+}
+
+func newIndex(oldbs []byte, cfg *config) *Index {
+	ix := &Index{
+		oldSum: oldSum(oldbs, cfg),
+		filter: oldFilter(oldbs, cfg),
+		cfg:    cfg,
+	}
+	ix.old = ix.filter.Encode(oldbs)
+	ix.sa = buildSuffixArray(ix.old, cfg.sorter)
+	return ix
+}
+
+// oldSum returns the checksum of oldbs, or nil if the algorithm is unknown;
+// diffb reports that error.
+func oldSum(oldbs []byte, cfg *config) []byte {
+	sum, _ := cfg.checksum.Sum(oldbs)
+	return sum
+}
+
+// oldFilter returns the filter for oldbs if WithELFFilter is set.
+func oldFilter(oldbs []byte, cfg *config) filter.ID {
+	if !cfg.elfFilter {
+		return filter.None
+	}
+	return filter.Detect(oldbs)
+}
+
+// Diff writes a patch from the indexed old file to newbs.
+func (ix *Index) Diff(newbs []byte, patch io.Writer) error {
+	return ix.DiffContext(context.Background(), newbs, patch)
+}
+
+// DiffContext is like Diff but returns ctx.Err() if ctx is done before the
+// diff is complete.
+func (ix *Index) DiffContext(ctx context.Context, newbs []byte, patch io.Writer) error {
+	return ix.diff(ctx, newbs, patch)
+}
+
+// Bytes returns a patch from the indexed old file to newbs.
+func (ix *Index) Bytes(newbs []byte) ([]byte, error) {
+	return ix.diffb(context.Background(), newbs)
+}
+
+// WriteTo writes the index to w. The old file itself is not included; pass
+// it to ReadIndex when loading the index again.
+func (ix *Index) WriteTo(w io.Writer) (int64, error) {
+	width := 4
+	if _, ok := ix.sa.(suffixArray32); !ok {
+		width = 8
+	}
+
+	header := make([]byte, indexHeaderLen)
+	copy(header, indexMagic)
+	header[8] = indexVersion
+	header[9] = byte(width)
+	binary.LittleEndian.PutUint64(header[16:], uint64(len(ix.old)))
+	oldSum := sha256.Sum256(ix.old)
+	copy(header[24:], oldSum[:])
+
+	bw := bufio.NewWriter(w)
+	wc := &countWriter{w: bw}
+	if _, err := wc.Write(header); err != nil {
+		return wc.n, err
+	}
+	entry := make([]byte, width)
+	for i := 0; i < ix.sa.len(); i++ {
+		if width == 4 {
+			binary.LittleEndian.PutUint32(entry, uint32(ix.sa.at(i)))
+		} else {
+			binary.LittleEndian.PutUint64(entry, uint64(ix.sa.at(i)))
+		}
+		if _, err := wc.Write(entry); err != nil {
+			return wc.n, err
+		}
+	}
+	return wc.n, bw.Flush()
+}
+
+// ReadIndex reads an index written by Index.WriteTo. oldbs must be the file
+// the index was built from; otherwise ErrIndexMismatch is returned.
+func ReadIndex(r io.Reader, oldbs []byte, opts ...Option) (*Index, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, indexHeaderLen)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("bsdiff: could not read index header: %v", err)
+	}
+	if !bytes.Equal(header[:8], []byte(indexMagic)) {
+		return nil, errors.New("bsdiff: not an index (incorrect magic)")
+	}
+	if header[8] != indexVersion {
+		return nil, fmt.Errorf("bsdiff: unsupported index version %v", header[8])
+	}
+	width := int(header[9])
+	if width != 4 && width != 8 {
+		return nil, fmt.Errorf("bsdiff: invalid index entry size %v", width)
+	}
+
+	cfg := newConfig(opts)
+	ix := &Index{
+		oldSum: oldSum(oldbs, cfg),
+		filter: oldFilter(oldbs, cfg),
+		cfg:    cfg,
+	}
+	// The index is of the filtered old file
+	oldbs = ix.filter.Encode(oldbs)
+	ix.old = oldbs
+	indexSum := sha256.Sum256(oldbs)
+	if binary.LittleEndian.Uint64(header[16:]) != uint64(len(oldbs)) ||
+		!bytes.Equal(header[24:56], indexSum[:]) {
+		return nil, ErrIndexMismatch
+	}
+	if width == 4 && len(oldbs) >= math.MaxInt32 {
+		return nil, fmt.Errorf("bsdiff: invalid index entry size %v", width)
+	}
+
+	// Every entry is range checked so a damaged index can't make search
+	// index outside of oldbs.
+	n := len(oldbs) + 1
+	entry := make([]byte, width)
+	var sa32 suffixArray32
+	var sa64 suffixArray64
+	if width == 4 {
+		sa32 = make(suffixArray32, n)
+		ix.sa = sa32
+	} else {
+		sa64 = make(suffixArray64, n)
+		ix.sa = sa64
+	}
+	for i := 0; i < n; i++ {
+		if _, err := io.ReadFull(br, entry); err != nil {
+			return nil, fmt.Errorf("bsdiff: could not read index: %v", err)
+		}
+		var v uint64
+		if width == 4 {
+			v = uint64(binary.LittleEndian.Uint32(entry))
+			sa32[i] = int32(v)
+		} else {
+			v = binary.LittleEndian.Uint64(entry)
+			sa64[i] = int64(v)
+		}
+		if v > uint64(len(oldbs)) {
+			return nil, fmt.Errorf("bsdiff: corrupt index: entry %v out of range", i)
+		}
+	}
+	return ix, nil
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
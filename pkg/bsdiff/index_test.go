@@ -0,0 +1,105 @@
+package bsdiff
+
+import (
+	"bytes"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+func indexTestFiles(seed int64, n int) (oldbs []byte, newbss [][]byte) {
+	rnd := rand.New(rand.NewSource(seed))
+	oldbs = make([]byte, 8192)
+	rnd.Read(oldbs)
+	for i := 0; i < n; i++ {
+		newbs := append([]byte{}, oldbs...)
+		for j := 0; j < 10; j++ {
+			newbs[rnd.Intn(len(newbs))] = byte(rnd.Intn(256))
+		}
+		newbss = append(newbss, append(newbs, byte(i)))
+	}
+	return oldbs, newbss
+}
+
+func TestIndexDiff(t *testing.T) {
+	oldbs, newbss := indexTestFiles(1, 8)
+	ix := NewIndex(oldbs)
+
+	var wg sync.WaitGroup
+	patches := make([][]byte, len(newbss))
+	errs := make([]error, len(newbss))
+	for i := range newbss {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			buf := new(bytes.Buffer)
+			errs[i] = ix.Diff(newbss[i], buf)
+			patches[i] = buf.Bytes()
+		}(i)
+	}
+	wg.Wait()
+
+	for i, newbs := range newbss {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		expected, err := Bytes(oldbs, newbs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(patches[i], expected) {
+			t.Fatalf("patch %v differs from Bytes", i)
+		}
+	}
+}
+
+func TestIndexReadWrite(t *testing.T) {
+	oldbs, newbss := indexTestFiles(2, 1)
+	for _, sorter := range []SuffixSorter{SAIS, QSufSort} {
+		ix := NewIndex(oldbs, WithSuffixSorter(sorter))
+		buf := new(bytes.Buffer)
+		n, err := ix.WriteTo(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(buf.Len()) {
+			t.Fatal(n, "!=", buf.Len())
+		}
+
+		ix2, err := ReadIndex(bytes.NewReader(buf.Bytes()), oldbs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p1, err := ix.Bytes(newbss[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		p2, err := ix2.Bytes(newbss[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(p1, p2) {
+			t.Fatal("patch from loaded index differs")
+		}
+
+		// wrong old file
+		if _, err := ReadIndex(bytes.NewReader(buf.Bytes()), newbss[0][:len(oldbs)]); err != ErrIndexMismatch {
+			t.Fatal("expected ErrIndexMismatch, got", err)
+		}
+		// truncated index
+		if _, err := ReadIndex(bytes.NewReader(buf.Bytes()[:buf.Len()-1]), oldbs); err == nil {
+			t.Fatal("truncated index should fail")
+		}
+		// out of range entry
+		corrupt := append([]byte{}, buf.Bytes()...)
+		for i := indexHeaderLen; i < len(corrupt); i++ {
+			corrupt[i] = 0xFF
+		}
+		if _, err := ReadIndex(bytes.NewReader(corrupt), oldbs); err == nil {
+			t.Fatal("out of range entry should fail")
+		}
+	}
+	if _, err := ReadIndex(bytes.NewReader([]byte("BSDIFF40")), oldbs); err == nil {
+		t.Fatal("short header should fail")
+	}
+}
@@ -0,0 +1,36 @@
+//go:build linux
+
+package bsdiff
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+)
+
+// mapFile maps the file name read-only into memory, so its pages are read
+// on demand and can be dropped by the kernel instead of living on the heap.
+// Files that can't be mapped, such as pipes, are read instead, and mapped is
+// false. The returned function releases the mapping.
+func mapFile(name string) (b []byte, mapped bool, unmap func() error, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, false, nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, false, nil, err
+	}
+	size := fi.Size()
+	if !fi.Mode().IsRegular() || size == 0 || int64(int(size)) != size {
+		b, err := ioutil.ReadAll(f)
+		return b, false, func() error { return nil }, err
+	}
+	b, err = syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		b, err := ioutil.ReadAll(f)
+		return b, false, func() error { return nil }, err
+	}
+	return b, true, func() error { return syscall.Munmap(b) }, nil
+}
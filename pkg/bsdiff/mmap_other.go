@@ -0,0 +1,12 @@
+//go:build !linux
+
+package bsdiff
+
+import "io/ioutil"
+
+// mapFile reads the file name into memory, so mapped is always false. Only
+// Linux maps it instead.
+func mapFile(name string) (b []byte, mapped bool, unmap func() error, err error) {
+	b, err = ioutil.ReadFile(name)
+	return b, false, func() error { return nil }, err
+}
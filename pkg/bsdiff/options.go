@@ -0,0 +1,252 @@
+package bsdiff
+
+import (
+	"errors"
+	"math"
+
+	"github.com/kiteco/go-bsdiff/v2/pkg/checksum"
+	"github.com/kiteco/go-bsdiff/v2/pkg/codec"
+)
+
+// ErrMemoryLimit is returned when a diff would need more memory than the
+// limit set with WithMemoryLimit.
+var ErrMemoryLimit = errors.New("bsdiff: diff exceeds memory limit")
+
+// SuffixSorter selects the algorithm used to build the suffix array of the
+// old file.
+type SuffixSorter int
+
+const (
+	// SAIS builds the suffix array in linear time with SA-IS, using 32-bit
+	// indices when the old file is smaller than 2 GiB.
+	SAIS SuffixSorter = iota
+	// QSufSort is the original Larsson-Sadakane qsufsort used by bsdiff 4.
+	// It is slower and needs two machine-word indices per byte of the old
+	// file, but is kept so the two builders can be compared.
+	QSufSort
+)
+
+// Format selects the layout of the generated patch.
+type Format int
+
+const (
+	// FormatChecksummed is this package's BSDIFF40 layout. Its 64-byte
+	// header also holds the SHA-256 of the old file, which bspatch checks
+	// before applying the patch.
+	FormatChecksummed Format = iota
+	// FormatClassic is the upstream bsdiff 4 layout with a 32-byte header.
+	// It can be applied by the reference C bspatch, Python's bsdiff4 and
+	// Android's tooling, but carries no checksum of the old file.
+	FormatClassic
+	// FormatExtended records the codec used for each block in its header,
+	// so it can use any codec.Codec, and the SHA-256 of the new file, which
+	// bspatch checks after patching. It is only understood by this
+	// package's bspatch.
+	FormatExtended
+)
+
+// ProgressFunc is called periodically with the number of bytes of the new
+// file processed so far and its total size.
+type ProgressFunc func(done, total int64)
+
+// Option configures how a patch is generated.
+type Option func(*config)
+
+type config struct {
+	sorter   SuffixSorter
+	format   Format
+	codec    codec.ID
+	level    int
+	checksum checksum.Algorithm
+	memLimit int64
+	tempDir  string
+	progress ProgressFunc
+
+	concurrency      int
+	tolerance        float64
+	blockConcurrency int
+	// minChunk is the smallest part of the new file diffed on its own
+	// goroutine, defaultMinChunk outside of tests.
+	minChunk int
+
+	tarNameMatching bool
+	elfFilter       bool
+}
+
+func newConfig(opts []Option) *config {
+	c := &config{
+		sorter:   SAIS,
+		format:   FormatChecksummed,
+		codec:    codec.Bzip2,
+		level:    codec.DefaultLevel,
+		checksum: checksum.SHA256,
+
+		concurrency: 1,
+		tolerance:   defaultTolerance,
+		minChunk:    defaultMinChunk,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// WithSuffixSorter selects the suffix array builder. Both builders produce
+// identical patches.
+func WithSuffixSorter(s SuffixSorter) Option {
+	return func(c *config) {
+		c.sorter = s
+	}
+}
+
+// WithFormat selects the patch layout. The default is FormatChecksummed.
+func WithFormat(f Format) Option {
+	return func(c *config) {
+		c.format = f
+	}
+}
+
+// WithCodec selects the codec used to compress the patch blocks. Any codec
+// other than the default codec.Bzip2 requires FormatExtended.
+func WithCodec(id codec.ID) Option {
+	return func(c *config) {
+		c.codec = id
+	}
+}
+
+// WithProgress sets a callback that reports how much of the new file has
+// been scanned. A serial diff calls it from the diffing goroutine. With
+// WithConcurrency, it is called from the goroutines that diff the chunks,
+// one call at a time under a mutex, so it must not block for long.
+func WithProgress(f ProgressFunc) Option {
+	return func(c *config) {
+		c.progress = f
+	}
+}
+
+// WithLevel sets the compression level, from codec.BestSpeed to
+// codec.BestCompression; package codec describes how each codec uses it.
+// The default, codec.DefaultLevel, is the codec's own default; for bzip2
+// that is its best compression.
+func WithLevel(level int) Option {
+	return func(c *config) {
+		c.level = level
+	}
+}
+
+// WithChecksum selects the algorithm used to checksum the old and new
+// files. Any algorithm other than the default checksum.SHA256 requires
+// FormatExtended.
+func WithChecksum(a checksum.Algorithm) Option {
+	return func(c *config) {
+		c.checksum = a
+	}
+}
+
+// WithMemoryLimit makes diffs fail with ErrMemoryLimit instead of
+// allocating more than about n bytes. Zero means no limit.
+func WithMemoryLimit(n int64) Option {
+	return func(c *config) {
+		c.memLimit = n
+	}
+}
+
+// WithTempDir sets the directory for the temporary files that hold large
+// compressed blocks while a patch is generated. The default is os.TempDir.
+func WithTempDir(dir string) Option {
+	return func(c *config) {
+		c.tempDir = dir
+	}
+}
+
+// WithConcurrency splits the new file into up to n chunks that are diffed
+// against the old file on their own goroutines. Patches from a parallel diff
+// can be slightly larger than serial ones; see WithParallelTolerance. The
+// default, 1, diffs serially and produces the same patches as bsdiff 4.
+func WithConcurrency(n int) Option {
+	return func(c *config) {
+		c.concurrency = n
+	}
+}
+
+// WithParallelTolerance sets, as a fraction, how much a chunk boundary of a
+// parallel diff may cost. A boundary's cost is estimated from the control
+// triple and the extra bytes that starting a chunk adds, and compared with
+// the chunk after it: its control triples, nonzero diff bytes and extra
+// bytes. Each boundary that costs more than that fraction of its chunk is
+// removed by diffing both chunks again as one, so those parts of the new
+// file are diffed twice. Both sizes are estimated before compression and
+// each boundary is checked on its own, so this doesn't bound how much
+// larger the patch is than a serial one. The default is 0.01.
+func WithParallelTolerance(f float64) Option {
+	return func(c *config) {
+		c.tolerance = f
+	}
+}
+
+// WithBlockConcurrency compresses blocks larger than codec.SegmentSize on
+// up to n goroutines each, if the codec implements
+// codec.ConcurrentCompressor. Such blocks are written as several
+// concatenated streams, which the reference bspatch cannot read, so this
+// cannot be used with FormatClassic. The default, 1, compresses each block
+// on a single goroutine.
+func WithBlockConcurrency(n int) Option {
+	return func(c *config) {
+		c.blockConcurrency = n
+	}
+}
+
+// WithTarNameMatching makes TarGz reorder the members of the old tar stream
+// to follow the members of the same name in the new one before diffing,
+// which helps when entries were added, removed or reordered. The order is
+// recorded in the patch.
+func WithTarNameMatching(on bool) Option {
+	return func(c *config) {
+		c.tarNameMatching = on
+	}
+}
+
+// WithELFFilter filters x86-64 and ARM64 ELF executables before diffing
+// them, which makes patches between builds of a program much smaller; see
+// package filter. The filter is chosen from the old file and recorded in
+// the patch, so it requires FormatExtended. Other files are diffed as
+// usual.
+func WithELFFilter(on bool) Option {
+	return func(c *config) {
+		c.elfFilter = on
+	}
+}
+
+// checkMemory estimates the memory needed to diff an old file of oldsize
+// bytes: its suffix array, a constant for the block buffers, and inMemory
+// bytes of input and output that the caller holds on the heap.
+func (c *config) checkMemory(oldsize int, inMemory int64) error {
+	if c.memLimit <= 0 {
+		return nil
+	}
+	perEntry := int64(4)
+	switch {
+	case c.sorter == QSufSort:
+		perEntry = 16
+	case oldsize >= math.MaxInt32:
+		perEntry = 8
+	}
+	need := perEntry*int64(oldsize+1) + 3*(spillThreshold+(1+asyncBuffers)*blockBufferSize) + inMemory
+	if c.blockConcurrency > 1 {
+		// Each segment is held twice, before and after compression
+		need += 3 * 2 * int64(c.blockConcurrency) * codec.SegmentSize
+	}
+	if c.concurrency > 1 {
+		// The chunks' uncompressed diff and extra bytes
+		need += 2 * spillThreshold
+	}
+	if c.elfFilter {
+		// Filtered copies of the old file and of the new one, taken to be
+		// about as large
+		need += 2 * int64(oldsize)
+	}
+	if need > c.memLimit {
+		return ErrMemoryLimit
+	}
+	return nil
+}
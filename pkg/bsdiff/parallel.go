@@ -0,0 +1,215 @@
+package bsdiff
+
+import (
+	"bufio"
+	"context"
+	"sync"
+)
+
+const (
+	// defaultMinChunk is the smallest part of the new file worth diffing
+	// on its own goroutine.
+	defaultMinChunk = 1 << 20
+	// defaultTolerance is the default for WithParallelTolerance.
+	defaultTolerance = 0.01
+)
+
+// chunk is one part of the new file, newbin[start:end], diffed on its own
+// goroutine. Its control triples and uncompressed diff and extra bytes are
+// kept until all chunks are done, then written out in order.
+type chunk struct {
+	start, end int
+	// lastpos is where the scan of the chunk starts in the old file, and
+	// oldEnd where the add of its last triple ends.
+	lastpos, oldEnd int
+	triples         [][3]int
+	db, eb          *spillBuffer
+	// nonzero counts the diff bytes that are not zero.
+	nonzero int
+	scanned int
+}
+
+// dbWrite writes diff bytes to c.db, counting those that are not zero.
+func (c *chunk) dbWrite(p []byte) (int, error) {
+	for _, b := range p {
+		if b != 0 {
+			c.nonzero++
+		}
+	}
+	return c.db.Write(p)
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+// size estimates what the chunk adds to the uncompressed patch: its
+// control triples, its diff bytes that are not zero and its extra bytes.
+func (c *chunk) size() int {
+	return 24*len(c.triples) + c.nonzero + int(c.eb.Len())
+}
+
+// boundaryCost estimates what starting the chunk on its own adds to the
+// patch. A serial scan would usually have carried on into it without a new
+// triple, and if the chunk doesn't start with a match, it would have found
+// the extra bytes at its start in the old file.
+func (c *chunk) boundaryCost() int {
+	if c.triples[0][0] > 0 {
+		return 24
+	}
+	return 24 + c.triples[0][1]
+}
+
+// scanParallel diffs the new file in chunks on up to ix.cfg.concurrency
+// goroutines and writes the merged result to out. It reports false, having
+// written nothing, if the new file is too small to split.
+//
+// The boundary before a chunk is kept if it costs at most ix.cfg.tolerance
+// of the chunk's size. Otherwise the chunk is merged with the one before it
+// and both are scanned again as one, so those parts of the new file are
+// scanned twice. Progress is reported for the first scan only.
+func (ix *Index) scanParallel(ctx context.Context, newbin []byte, out scanOutput) (bool, error) {
+	n := ix.cfg.concurrency
+	if max := len(newbin) / ix.cfg.minChunk; n > max {
+		n = max
+	}
+	if n < 2 {
+		return false, nil
+	}
+
+	var all []*chunk
+	defer func() {
+		for _, c := range all {
+			c.db.Close()
+			c.eb.Close()
+		}
+	}()
+	limit := spillThreshold / n
+	newChunk := func(start, end, lastpos int) *chunk {
+		c := &chunk{
+			start:   start,
+			end:     end,
+			lastpos: lastpos,
+			db:      newSpillBuffer(ix.cfg.tempDir),
+			eb:      newSpillBuffer(ix.cfg.tempDir),
+		}
+		c.db.limit, c.eb.limit = limit, limit
+		all = append(all, c)
+		return c
+	}
+	chunks := make([]*chunk, n)
+	for i := range chunks {
+		c := newChunk(i*len(newbin)/n, (i+1)*len(newbin)/n, 0)
+		if i > 0 {
+			// Start where the old file best matches the start of the
+			// chunk, as a serial scan most likely would.
+			search(ix.sa, ix.old, newbin[c.start:c.end], 0, len(ix.old), &c.lastpos)
+		}
+		chunks[i] = c
+	}
+
+	var mu sync.Mutex
+	progress := func(c *chunk, scanned int) {
+		if out.progress == nil {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		c.scanned = scanned
+		var total int
+		for _, c := range chunks {
+			total += c.scanned
+		}
+		out.progress(total)
+	}
+	if err := ix.scanChunks(ctx, newbin, chunks, progress); err != nil {
+		return false, err
+	}
+
+	// Merge chunks across the boundaries that cost too much, and scan the
+	// merged chunks again
+	merged := chunks[:1]
+	var again []*chunk
+	for _, c := range chunks[1:] {
+		if float64(c.boundaryCost()) <= ix.cfg.tolerance*float64(c.size()) {
+			merged = append(merged, c)
+			continue
+		}
+		prev := merged[len(merged)-1]
+		if len(again) == 0 || again[len(again)-1] != prev {
+			prev = newChunk(prev.start, prev.end, prev.lastpos)
+			merged[len(merged)-1] = prev
+			again = append(again, prev)
+		}
+		prev.end = c.end
+	}
+	if err := ix.scanChunks(ctx, newbin, again, nil); err != nil {
+		return false, err
+	}
+
+	for i, c := range merged {
+		if i+1 < len(merged) {
+			// Seek from the end of this chunk to the start of the next
+			c.triples[len(c.triples)-1][2] = merged[i+1].lastpos - c.oldEnd
+		}
+		for _, t := range c.triples {
+			if err := out.ctrl(t[0], t[1], t[2]); err != nil {
+				return false, err
+			}
+		}
+		if _, err := c.db.WriteTo(out.db); err != nil {
+			return false, err
+		}
+		if _, err := c.eb.WriteTo(out.eb); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// scanChunks scans each of chunks on its own goroutine, reporting progress
+// if it is not nil.
+func (ix *Index) scanChunks(ctx context.Context, newbin []byte, chunks []*chunk, progress func(c *chunk, scanned int)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := make([]error, len(chunks))
+	var wg sync.WaitGroup
+	for i, c := range chunks {
+		wg.Add(1)
+		go func(i int, c *chunk) {
+			defer wg.Done()
+			dbw := bufio.NewWriterSize(writerFunc(c.dbWrite), blockBufferSize)
+			ebw := bufio.NewWriterSize(c.eb, blockBufferSize)
+			cout := scanOutput{
+				ctrl: func(x, y, seek int) error {
+					c.triples = append(c.triples, [3]int{x, y, seek})
+					return nil
+				},
+				db: dbw,
+				eb: ebw,
+			}
+			if progress != nil {
+				cout.progress = func(scanned int) { progress(c, scanned) }
+			}
+			var err error
+			if c.oldEnd, err = ix.scan(ctx, newbin, c.start, c.end, c.lastpos, cout); err == nil {
+				if err = dbw.Flush(); err == nil {
+					err = ebw.Flush()
+				}
+			}
+			if err != nil {
+				errs[i] = err
+				cancel()
+			}
+		}(i, c)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil && err != context.Canceled {
+			return err
+		}
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,174 @@
+package bsdiff
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/kiteco/go-bsdiff/v2/pkg/bspatch"
+)
+
+// parallelTestFiles returns an old file of n bytes and a new file with a
+// few scattered changes and insertions.
+func parallelTestFiles(seed int64, n int) (oldbs, newbs []byte) {
+	rnd := rand.New(rand.NewSource(seed))
+	oldbs = make([]byte, n)
+	for i := range oldbs {
+		// Few distinct bytes so that the data resembles text
+		oldbs[i] = 'a' + byte(rnd.Intn(16))
+	}
+	newbs = append([]byte{}, oldbs...)
+	for i := 0; i < n/4096; i++ {
+		newbs[rnd.Intn(len(newbs))] = byte(rnd.Intn(256))
+	}
+	for i := 0; i < n/65536+1; i++ {
+		at := rnd.Intn(len(newbs))
+		ins := make([]byte, rnd.Intn(256))
+		rnd.Read(ins)
+		newbs = append(newbs[:at], append(ins, newbs[at:]...)...)
+	}
+	return oldbs, newbs
+}
+
+func withMinChunk(n int) Option {
+	return func(c *config) {
+		c.minChunk = n
+	}
+}
+
+func TestParallelDiff(t *testing.T) {
+	oldbs, newbs := parallelTestFiles(1, 256<<10)
+	serial, err := Bytes(oldbs, newbs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{2, 3, 8} {
+		var done int64
+		patch, err := Bytes(oldbs, newbs, WithConcurrency(n), WithParallelTolerance(1), withMinChunk(16<<10),
+			WithProgress(func(d, total int64) { done = d }))
+		if err != nil {
+			t.Fatal(n, err)
+		}
+		if bytes.Equal(patch, serial) {
+			t.Fatal(n, "patch was not diffed in parallel")
+		}
+		if done != int64(len(newbs)) {
+			t.Fatal(n, "progress ended at", done)
+		}
+		newbs2, err := bspatch.Bytes(oldbs, patch)
+		if err != nil {
+			t.Fatal(n, err)
+		}
+		if !bytes.Equal(newbs, newbs2) {
+			t.Fatal(n, "parallel patch does not reproduce the new file")
+		}
+		if len(patch) > len(serial)*105/100 {
+			t.Fatal(n, "parallel patch is", len(patch), "bytes, serial", len(serial))
+		}
+	}
+}
+
+func TestParallelDiffTolerance(t *testing.T) {
+	oldbs, newbs := parallelTestFiles(2, 128<<10)
+	serial, err := Bytes(oldbs, newbs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// With no tolerance any boundary costs too much, so the chunks are
+	// merged into one and scanned again serially. Progress doesn't go back
+	// for the second scan.
+	var done int64
+	progress := WithProgress(func(d, total int64) {
+		if d < done {
+			t.Error("progress went from", done, "back to", d)
+		}
+		done = d
+	})
+	patch, err := Bytes(oldbs, newbs, WithConcurrency(4), WithParallelTolerance(0), withMinChunk(16<<10), progress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(patch, serial) {
+		t.Fatal("patch differs from the serial patch")
+	}
+	// Files smaller than two chunks are diffed serially too
+	patch, err = Bytes(oldbs, newbs, WithConcurrency(4), WithParallelTolerance(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(patch, serial) {
+		t.Fatal("small patch differs from the serial patch")
+	}
+}
+
+// TestParallelDiffDefaultTolerance checks that megabyte chunks with a few
+// changes each are kept apart with the default tolerance.
+func TestParallelDiffDefaultTolerance(t *testing.T) {
+	oldbs, newbs := parallelTestFiles(5, 2<<20)
+	serial, err := Bytes(oldbs, newbs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch, err := Bytes(oldbs, newbs, WithConcurrency(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(patch, serial) {
+		t.Fatal("patch was not diffed in parallel")
+	}
+	if len(patch) > len(serial)*101/100 {
+		t.Fatal("parallel patch is", len(patch), "bytes, serial", len(serial))
+	}
+}
+
+func TestParallelDiffContext(t *testing.T) {
+	oldbs, newbs := parallelTestFiles(3, 256<<10)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	d := New(WithConcurrency(4), withMinChunk(16<<10))
+	if err := d.DiffContext(ctx, oldbs, newbs, new(bytes.Buffer)); err != context.Canceled {
+		t.Fatal("expected context.Canceled, got", err)
+	}
+}
+
+func BenchmarkParallelDiff(b *testing.B) {
+	oldbs, newbs := parallelTestFiles(4, 8<<20)
+	for _, n := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("concurrency-%v", n), func(b *testing.B) {
+			// Each configuration sorts its own index, outside the timer
+			ix := New(WithConcurrency(n), WithParallelTolerance(1)).NewIndex(oldbs)
+			b.ResetTimer()
+			b.SetBytes(int64(len(newbs)))
+			var size int
+			for i := 0; i < b.N; i++ {
+				var buf bytes.Buffer
+				if err := ix.Diff(newbs, &buf); err != nil {
+					b.Fatal(err)
+				}
+				size = buf.Len()
+			}
+			b.ReportMetric(float64(size), "patch-bytes")
+		})
+	}
+}
+
+func TestParallelBidirectional(t *testing.T) {
+	oldbs, newbs := parallelTestFiles(3, 256<<10)
+	forward, reverse, err := Bidirectional(oldbs, newbs, WithConcurrency(4), WithParallelTolerance(1), withMinChunk(16<<10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newbs2, err := bspatch.Bytes(oldbs, forward)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldbs2, err := bspatch.Bytes(newbs2, reverse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(newbs, newbs2) || !bytes.Equal(oldbs, oldbs2) {
+		t.Fatal("parallel forward and reverse patches do not round trip")
+	}
+}
@@ -0,0 +1,128 @@
+package bsdiff
+
+import (
+	"bytes"
+	"context"
+	"sort"
+)
+
+// matchRun is a run of the new file that a patch makes from the old file
+// plus diff bytes.
+type matchRun struct {
+	newpos, oldpos, n int
+}
+
+// Bidirectional returns a patch from oldbs to newbs and one from newbs back
+// to oldbs. See Differ.Bidirectional.
+func Bidirectional(oldbs, newbs []byte, opts ...Option) (forward, reverse []byte, err error) {
+	return New(opts...).Bidirectional(oldbs, newbs)
+}
+
+// Bidirectional returns a patch from oldbs to newbs and one from newbs back
+// to oldbs, for rolling an update back. Only oldbs is suffix sorted: the
+// reverse patch takes each run of oldbs that the forward patch matched from
+// where it ended up in newbs, and the rest of oldbs from its extra block.
+// Both patches have the same options, and WithProgress reports the forward
+// patch and then the reverse one.
+func (d *Differ) Bidirectional(oldbs, newbs []byte) (forward, reverse []byte, err error) {
+	// Both files and both patches are held in memory
+	if err := d.cfg.checkMemory(len(oldbs), 2*int64(len(oldbs))+2*int64(len(newbs))); err != nil {
+		return nil, nil, err
+	}
+	ctx := context.Background()
+	ix := newIndex(oldbs, d.cfg)
+	var runs []matchRun
+	fw := new(bytes.Buffer)
+	err = ix.writePatch(ctx, newbs, fw, func(ctx context.Context, newbin []byte, out scanOutput) error {
+		ctrl := out.ctrl
+		var newpos, oldpos int
+		out.ctrl = func(x, y, seek int) error {
+			if x > 0 {
+				runs = append(runs, matchRun{newpos, oldpos, x})
+			}
+			newpos += x + y
+			oldpos += x + seek
+			return ctrl(x, y, seek)
+		}
+		return ix.scanAll(ctx, newbin, out)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The reverse patch is written from an index of newbs without its
+	// suffix array, which invertRuns doesn't need
+	rix := &Index{
+		oldSum: oldSum(newbs, d.cfg),
+		filter: oldFilter(newbs, d.cfg),
+		cfg:    d.cfg,
+	}
+	rix.old = rix.filter.Encode(newbs)
+	rv := new(bytes.Buffer)
+	err = rix.writePatch(ctx, oldbs, rv, func(ctx context.Context, newbin []byte, out scanOutput) error {
+		return invertRuns(runs, rix.old, newbin, out)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return fw.Bytes(), rv.Bytes(), nil
+}
+
+// invertRuns writes the control triples and blocks of a patch from old to
+// newbin, given runs of a patch from newbin to old. Each byte of newbin is
+// taken from the run that covers it and reaches furthest, or from the extra
+// block if none covers it. runs is sorted in place.
+func invertRuns(runs []matchRun, old, newbin []byte, out scanOutput) error {
+	sort.Slice(runs, func(i, j int) bool { return runs[i].oldpos < runs[j].oldpos })
+
+	// The pending triple adds old from oldpos to diffLen diff bytes and
+	// copies extraLen extra bytes
+	var oldpos, diffLen, extraLen int
+	flush := func(seek int) error {
+		err := out.ctrl(diffLen, extraLen, seek)
+		oldpos += diffLen + seek
+		diffLen, extraLen = 0, 0
+		return err
+	}
+
+	best := -1
+	end := func(i int) int { return runs[i].oldpos + runs[i].n }
+	next := 0
+	for pos := 0; pos < len(newbin); {
+		for ; next < len(runs) && runs[next].oldpos <= pos; next++ {
+			if best < 0 || end(next) > end(best) {
+				best = next
+			}
+		}
+		if best >= 0 && end(best) > pos {
+			r := runs[best]
+			from := r.newpos + pos - r.oldpos
+			if extraLen > 0 || oldpos+diffLen != from {
+				if err := flush(from - oldpos - diffLen); err != nil {
+					return err
+				}
+			}
+			for i := pos; i < end(best); i++ {
+				if err := out.db.WriteByte(newbin[i] - old[from+i-pos]); err != nil {
+					return err
+				}
+			}
+			diffLen += end(best) - pos
+			pos = end(best)
+			continue
+		}
+		gapEnd := len(newbin)
+		if next < len(runs) {
+			gapEnd = runs[next].oldpos
+		}
+		if _, err := out.eb.Write(newbin[pos:gapEnd]); err != nil {
+			return err
+		}
+		extraLen += gapEnd - pos
+		pos = gapEnd
+	}
+	if diffLen > 0 || extraLen > 0 {
+		return flush(0)
+	}
+	return nil
+}
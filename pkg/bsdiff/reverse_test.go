@@ -0,0 +1,90 @@
+package bsdiff
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/kiteco/go-bsdiff/v2/pkg/bspatch"
+	"github.com/kiteco/go-bsdiff/v2/pkg/codec"
+)
+
+// mutate returns a copy of b with random bytes changed, inserted and
+// removed, and a few blocks moved.
+func mutate(rnd *rand.Rand, b []byte) []byte {
+	out := append([]byte(nil), b...)
+	for i := 0; i < 20; i++ {
+		pos := rnd.Intn(len(out))
+		switch rnd.Intn(4) {
+		case 0:
+			out[pos] ^= byte(1 + rnd.Intn(255))
+		case 1:
+			ins := make([]byte, rnd.Intn(200))
+			rnd.Read(ins)
+			out = append(out[:pos], append(ins, out[pos:]...)...)
+		case 2:
+			out = append(out[:pos], out[min(len(out), pos+rnd.Intn(200)):]...)
+		case 3:
+			from := rnd.Intn(len(out))
+			blk := append([]byte(nil), out[from:min(len(out), from+500)]...)
+			out = append(out[:pos], append(blk, out[pos:]...)...)
+		}
+	}
+	return out
+}
+
+func TestBidirectional(t *testing.T) {
+	rnd := rand.New(rand.NewSource(3))
+	a := make([]byte, 100000)
+	for i := range a {
+		a[i] = byte('a' + rnd.Intn(4))
+	}
+	b := mutate(rnd, a)
+	for _, test := range []struct {
+		name     string
+		old, new []byte
+		opts     []Option
+	}{
+		{"checksummed", a, b, nil},
+		{"classic", a, b, []Option{WithFormat(FormatClassic)}},
+		{"extended", a, b, []Option{WithFormat(FormatExtended), WithCodec(codec.Zstd)}},
+		{"empty old", nil, b, nil},
+		{"empty new", a, nil, nil},
+		{"executable", makeExecutable(nil), makeExecutable([]byte("inserted code")),
+			[]Option{WithFormat(FormatExtended), WithELFFilter(true)}},
+	} {
+		forward, reverse, err := Bidirectional(test.old, test.new, test.opts...)
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+		newbs, err := bspatch.Bytes(test.old, forward)
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+		if !bytes.Equal(newbs, test.new) {
+			t.Fatalf("%s: forward patch does not reproduce the new file", test.name)
+		}
+		oldbs, err := bspatch.Bytes(newbs, reverse)
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+		if !bytes.Equal(oldbs, test.old) {
+			t.Fatalf("%s: reverse patch does not restore the old file", test.name)
+		}
+		// The forward patch is the one a plain diff makes
+		plain, err := Bytes(test.old, test.new, test.opts...)
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+		if !bytes.Equal(forward, plain) {
+			t.Errorf("%s: forward patch differs from a plain diff", test.name)
+		}
+		direct, err := Bytes(test.new, test.old, test.opts...)
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+		if len(reverse) > len(direct)*11/10 {
+			t.Errorf("%s: reverse patch is %v bytes, a direct diff %v", test.name, len(reverse), len(direct))
+		}
+	}
+}
@@ -0,0 +1,217 @@
+// This file uses int32 indices and is the source for sais64.go, which is
+// produced by replacing every "32" with "64". Identifiers that must differ
+// between the two files therefore all contain "32".
+
+//go:generate sh -c "(echo '// Code generated by go generate from sais.go; DO NOT EDIT.'; echo; sed -n '/^package/,$ p' sais.go | sed 's/32/64/g') > sais64.go"
+
+package bsdiff
+
+// SA-IS suffix array construction (Nong, Zhang and Chan, "Two Efficient
+// Algorithms for Linear Time Suffix Array Construction", 2009).
+//
+// The input is treated as if it were followed by a sentinel that sorts before
+// every byte, so the result has len(buf)+1 entries with the empty suffix at
+// index 0, which is exactly the layout qsufsort produces.
+
+// suffixSort32 returns the suffix array of buf. len(buf) must be less than
+// math.MaxInt32.
+func suffixSort32(buf []byte) []int32 {
+	sa := make([]int32, len(buf)+1)
+	sais32(&saText32{b: buf}, sa, 256)
+	return sa
+}
+
+// saText32 is the string sorted by one level of sais32: either the old file
+// shifted up by one to make room for the sentinel, or the reduced string of
+// LMS-substring names that the previous level stored at the end of its
+// suffix array.
+type saText32 struct {
+	b []byte
+	t []int32
+}
+
+func (x *saText32) len() int32 {
+	if x.t != nil {
+		return int32(len(x.t))
+	}
+	return int32(len(x.b)) + 1
+}
+
+func (x *saText32) at(i int32) int32 {
+	if x.t != nil {
+		return x.t[i]
+	}
+	if int(i) == len(x.b) {
+		return 0
+	}
+	return int32(x.b[i]) + 1
+}
+
+// saTypes32 is a bitset recording which suffixes are S-type.
+type saTypes32 []byte
+
+func (t saTypes32) s(i int32) bool { return t[i>>3]&(1<<uint(i&7)) != 0 }
+
+func (t saTypes32) set(i int32) { t[i>>3] |= 1 << uint(i&7) }
+
+func (t saTypes32) lms(i int32) bool { return i > 0 && t.s(i) && !t.s(i-1) }
+
+// sais32 writes the suffix array of x into sa. Every character of x is in
+// [0, k] and the last one is a unique 0.
+func sais32(x *saText32, sa []int32, k int32) {
+	n := x.len()
+	if n == 1 {
+		sa[0] = 0
+		return
+	}
+
+	// Classify each suffix as S-type or L-type. The sentinel is S-type and
+	// the character before it is always L-type.
+	t := make(saTypes32, (n+7)/8)
+	t.set(n - 1)
+	for i := n - 3; i >= 0; i-- {
+		c0, c1 := x.at(i), x.at(i+1)
+		if c0 < c1 || (c0 == c1 && t.s(i+1)) {
+			t.set(i)
+		}
+	}
+
+	// Stage 1: sort the LMS-substrings by placing every LMS suffix at the
+	// end of its bucket and inducing the rest.
+	bkt := make([]int32, k+1)
+	getBuckets32(x, bkt, true)
+	for i := range sa {
+		sa[i] = -1
+	}
+	for i := int32(1); i < n; i++ {
+		if t.lms(i) {
+			c := x.at(i)
+			bkt[c]--
+			sa[bkt[c]] = i
+		}
+	}
+	induceL32(x, t, sa, bkt)
+	induceS32(x, t, sa, bkt)
+
+	// Compact the sorted LMS-substrings into the front of sa.
+	var n1 int32
+	for i := int32(0); i < n; i++ {
+		if t.lms(sa[i]) {
+			sa[n1] = sa[i]
+			n1++
+		}
+	}
+
+	// Name each LMS-substring by its rank, storing the names in text order
+	// at the back of sa. LMS positions are at least two apart, so pos/2 is a
+	// unique slot.
+	for i := n1; i < n; i++ {
+		sa[i] = -1
+	}
+	name, prev := int32(0), int32(-1)
+	for i := int32(0); i < n1; i++ {
+		pos := sa[i]
+		diff := false
+		for d := int32(0); d < n; d++ {
+			if prev == -1 || x.at(pos+d) != x.at(prev+d) || t.s(pos+d) != t.s(prev+d) {
+				diff = true
+				break
+			} else if d > 0 && (t.lms(pos+d) || t.lms(prev+d)) {
+				break
+			}
+		}
+		if diff {
+			name++
+			prev = pos
+		}
+		sa[n1+pos/2] = name - 1
+	}
+	j := n - 1
+	for i := n - 1; i >= n1; i-- {
+		if sa[i] >= 0 {
+			sa[j] = sa[i]
+			j--
+		}
+	}
+
+	// Stage 2: sort the reduced string, recursing only if some names repeat.
+	sa1, s1 := sa[:n1], sa[n-n1:]
+	if name < n1 {
+		sais32(&saText32{t: s1}, sa1, name-1)
+	} else {
+		for i := int32(0); i < n1; i++ {
+			sa1[s1[i]] = i
+		}
+	}
+
+	// Stage 3: place the LMS suffixes in their final order and induce the
+	// full suffix array from them.
+	getBuckets32(x, bkt, true)
+	j = 0
+	for i := int32(1); i < n; i++ {
+		if t.lms(i) {
+			s1[j] = i
+			j++
+		}
+	}
+	for i := int32(0); i < n1; i++ {
+		sa1[i] = s1[sa1[i]]
+	}
+	for i := n1; i < n; i++ {
+		sa[i] = -1
+	}
+	for i := n1 - 1; i >= 0; i-- {
+		p := sa[i]
+		sa[i] = -1
+		c := x.at(p)
+		bkt[c]--
+		sa[bkt[c]] = p
+	}
+	induceL32(x, t, sa, bkt)
+	induceS32(x, t, sa, bkt)
+}
+
+// getBuckets32 sets bkt[c] to the start (or end) of the bucket holding the
+// suffixes beginning with c.
+func getBuckets32(x *saText32, bkt []int32, end bool) {
+	for i := range bkt {
+		bkt[i] = 0
+	}
+	n := x.len()
+	for i := int32(0); i < n; i++ {
+		bkt[x.at(i)]++
+	}
+	var sum int32
+	for i := range bkt {
+		sum += bkt[i]
+		if end {
+			bkt[i] = sum
+		} else {
+			bkt[i] = sum - bkt[i]
+		}
+	}
+}
+
+func induceL32(x *saText32, t saTypes32, sa []int32, bkt []int32) {
+	getBuckets32(x, bkt, false)
+	for i := range sa {
+		j := sa[i] - 1
+		if j >= 0 && !t.s(j) {
+			c := x.at(j)
+			sa[bkt[c]] = j
+			bkt[c]++
+		}
+	}
+}
+
+func induceS32(x *saText32, t saTypes32, sa []int32, bkt []int32) {
+	getBuckets32(x, bkt, true)
+	for i := len(sa) - 1; i >= 0; i-- {
+		j := sa[i] - 1
+		if j >= 0 && t.s(j) {
+			c := x.at(j)
+			bkt[c]--
+			sa[bkt[c]] = j
+		}
+	}
+}
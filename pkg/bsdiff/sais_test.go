@@ -0,0 +1,88 @@
+package bsdiff
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func saisInputs() [][]byte {
+	rnd := rand.New(rand.NewSource(1))
+	inputs := [][]byte{
+		{},
+		{0x00},
+		{0xFF},
+		{0xFF, 0xFA, 0xB7, 0xDD},
+		[]byte("mississippi"),
+		[]byte("abracadabra abracadabra"),
+		bytes.Repeat([]byte{0}, 1000),
+		bytes.Repeat([]byte("ab"), 777),
+		bytes.Repeat([]byte("abcabd"), 333),
+	}
+	for _, size := range []int{2, 3, 17, 256, 4096, 65536} {
+		random := make([]byte, size)
+		rnd.Read(random)
+		inputs = append(inputs, random)
+
+		// small alphabets produce long repeats and deep recursion
+		lowEntropy := make([]byte, size)
+		for i := range lowEntropy {
+			lowEntropy[i] = byte(rnd.Intn(3))
+		}
+		inputs = append(inputs, lowEntropy)
+	}
+	return inputs
+}
+
+func TestSuffixSortMatchesQsufsort(t *testing.T) {
+	for _, buf := range saisInputs() {
+		iii := make([]int, len(buf)+1)
+		qsufsort(iii, buf)
+		sa32 := suffixSort32(buf)
+		sa64 := suffixSort64(buf)
+		for i := range iii {
+			if int(sa32[i]) != iii[i] || int(sa64[i]) != iii[i] {
+				t.Fatalf("len %v: suffix %v: qsufsort %v, sais32 %v, sais64 %v", len(buf), i, iii[i], sa32[i], sa64[i])
+			}
+		}
+	}
+}
+
+func TestSuffixSorterPatchesEqual(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	oldbs := make([]byte, 1024*16)
+	rnd.Read(oldbs)
+	newbs := append([]byte{}, oldbs[:4096]...)
+	newbs = append(newbs, []byte("inserted bytes")...)
+	newbs = append(newbs, oldbs[8192:]...)
+	newbs[10000] ^= 0xFF
+
+	qpatch, err := Bytes(oldbs, newbs, WithSuffixSorter(QSufSort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	spatch, err := Bytes(oldbs, newbs, WithSuffixSorter(SAIS))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(qpatch, spatch) {
+		t.Fatal("qsufsort and SA-IS patches differ")
+	}
+}
+
+func BenchmarkSuffixSort(b *testing.B) {
+	buf := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(3)).Read(buf)
+	b.Run("QSufSort", func(b *testing.B) {
+		b.SetBytes(int64(len(buf)))
+		for i := 0; i < b.N; i++ {
+			buildSuffixArray(buf, QSufSort)
+		}
+	})
+	b.Run("SAIS", func(b *testing.B) {
+		b.SetBytes(int64(len(buf)))
+		for i := 0; i < b.N; i++ {
+			buildSuffixArray(buf, SAIS)
+		}
+	})
+}
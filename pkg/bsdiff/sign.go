@@ -0,0 +1,66 @@
+package bsdiff
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"errors"
+)
+
+// signedMagic starts a signed patch envelope.
+const signedMagic = "BSDIFFS1"
+
+// signatureContext is the Ed25519ph context of patch signatures, so they
+// can't be mistaken for signatures of anything else made with the same key.
+// It is stored in no patch but must never change.
+const signatureContext = "go-bsdiff signed patch v1"
+
+// maxSignatures is how many signatures an envelope can hold.
+const maxSignatures = 255
+
+// Sign wraps patch in an envelope signed with key, to be applied with
+// bspatch.VerifyAndApply. patch can be any patch made by this package. If
+// it is already signed, the signature is added to the others, so that
+// while keys are rotated a patch can be signed with the old and the new
+// key and accepted by devices trusting either.
+func Sign(patch []byte, key ed25519.PrivateKey) ([]byte, error) {
+	// Signed patch format:
+	// --- header ---
+	// 0 - 7 : "BSDIFFS1"
+	// 8     : number of signatures, at least 1
+	// For each signature:
+	//   32 bytes : Ed25519 public key
+	//   64 bytes : Ed25519ph signature of the SHA-512 of the patch, with
+	//              signatureContext as its context
+	// --- data ---
+	// The patch
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, errors.New("bsdiff: invalid Ed25519 private key")
+	}
+	var sigs []byte
+	if bytes.HasPrefix(patch, []byte(signedMagic)) {
+		if len(patch) < 9 || len(patch) < 9+int(patch[8])*(ed25519.PublicKeySize+ed25519.SignatureSize) {
+			return nil, errors.New("bsdiff: truncated signed patch")
+		}
+		if patch[8] == maxSignatures {
+			return nil, errors.New("bsdiff: too many signatures")
+		}
+		n := int(patch[8]) * (ed25519.PublicKeySize + ed25519.SignatureSize)
+		sigs = patch[9 : 9+n]
+		patch = patch[9+n:]
+	}
+
+	digest := sha512.Sum512(patch)
+	sig, err := key.Sign(nil, digest[:], &ed25519.Options{Hash: crypto.SHA512, Context: signatureContext})
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, 9+len(sigs)+ed25519.PublicKeySize+ed25519.SignatureSize+len(patch))
+	out = append(out, signedMagic...)
+	out = append(out, byte(len(sigs)/(ed25519.PublicKeySize+ed25519.SignatureSize)+1))
+	out = append(out, sigs...)
+	out = append(out, key.Public().(ed25519.PublicKey)...)
+	out = append(out, sig...)
+	return append(out, patch...), nil
+}
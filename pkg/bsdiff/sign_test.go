@@ -0,0 +1,47 @@
+package bsdiff
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"math/rand"
+	"testing"
+
+	"github.com/kiteco/go-bsdiff/v2/pkg/bspatch"
+)
+
+func TestSign(t *testing.T) {
+	patch, err := Bytes([]byte("the old file, signed"), []byte("the new file, signed twice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rnd := rand.New(rand.NewSource(1))
+	oldPub, oldKey, _ := ed25519.GenerateKey(rnd)
+	newPub, newKey, _ := ed25519.GenerateKey(rnd)
+
+	signed, err := Sign(patch, oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bspatch.Verify(signed, []ed25519.PublicKey{oldPub}); err != nil {
+		t.Fatal(err)
+	}
+
+	// While keys are rotated, patches are signed with both
+	signed, err = Sign(signed, newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []ed25519.PublicKey{oldPub, newPub} {
+		inner, err := bspatch.Verify(signed, []ed25519.PublicKey{key})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(inner, patch) {
+			t.Error("Verify does not return the signed patch")
+		}
+	}
+
+	if _, err := Sign(patch, ed25519.PrivateKey("short")); err == nil {
+		t.Error("expected an invalid private key to be rejected")
+	}
+}
@@ -0,0 +1,87 @@
+package bsdiff
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+const (
+	// spillThreshold is how large a compressed block grows in memory
+	// before it is moved to a temporary file.
+	spillThreshold = 8 << 20
+	// blockBufferSize is the size of the buffers in front of the diff and
+	// extra block compressors.
+	blockBufferSize = 64 << 10
+)
+
+// spillBuffer holds a compressed block while a patch is generated. It stays
+// in memory while it is small and moves to a temporary file in dir once it
+// grows past spillThreshold.
+type spillBuffer struct {
+	dir string
+	// limit is the size at which the buffer spills, spillThreshold outside
+	// of tests.
+	limit int
+	buf   bytes.Buffer
+	f     *os.File
+	n     int64
+}
+
+func newSpillBuffer(dir string) *spillBuffer {
+	return &spillBuffer{dir: dir, limit: spillThreshold}
+}
+
+func (s *spillBuffer) Write(p []byte) (int, error) {
+	if s.f == nil && s.buf.Len()+len(p) > s.limit {
+		f, err := ioutil.TempFile(s.dir, "bsdiff-")
+		if err != nil {
+			return 0, err
+		}
+		s.f = f
+		if _, err := s.buf.WriteTo(f); err != nil {
+			return 0, err
+		}
+		s.buf = bytes.Buffer{}
+	}
+	var n int
+	var err error
+	if s.f != nil {
+		n, err = s.f.Write(p)
+	} else {
+		n, err = s.buf.Write(p)
+	}
+	s.n += int64(n)
+	return n, err
+}
+
+// Len returns the number of bytes written.
+func (s *spillBuffer) Len() int64 {
+	return s.n
+}
+
+// WriteTo writes everything written so far to w.
+func (s *spillBuffer) WriteTo(w io.Writer) (int64, error) {
+	if s.f == nil {
+		return s.buf.WriteTo(w)
+	}
+	if _, err := s.f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.Copy(w, s.f)
+}
+
+// Close removes the temporary file, if any.
+func (s *spillBuffer) Close() error {
+	if s.f == nil {
+		return nil
+	}
+	name := s.f.Name()
+	err := s.f.Close()
+	if rerr := os.Remove(name); err == nil {
+		err = rerr
+	}
+	s.f = nil
+	return err
+}
@@ -0,0 +1,41 @@
+package bsdiff
+
+import "math"
+
+// suffixArray holds the start offsets of every suffix of the old file in
+// sorted order, including the empty suffix at index 0.
+type suffixArray interface {
+	// len returns the number of suffixes, which is len(old)+1.
+	len() int
+	// at returns the offset of the i-th smallest suffix.
+	at(i int) int
+}
+
+type suffixArray32 []int32
+
+func (sa suffixArray32) len() int     { return len(sa) }
+func (sa suffixArray32) at(i int) int { return int(sa[i]) }
+
+type suffixArray64 []int64
+
+func (sa suffixArray64) len() int     { return len(sa) }
+func (sa suffixArray64) at(i int) int { return int(sa[i]) }
+
+type suffixArrayInt []int
+
+func (sa suffixArrayInt) len() int     { return len(sa) }
+func (sa suffixArrayInt) at(i int) int { return sa[i] }
+
+// buildSuffixArray sorts the suffixes of buf with the requested algorithm.
+func buildSuffixArray(buf []byte, sorter SuffixSorter) suffixArray {
+	switch {
+	case sorter == QSufSort:
+		iii := make([]int, len(buf)+1)
+		qsufsort(iii, buf)
+		return suffixArrayInt(iii)
+	case len(buf) < math.MaxInt32:
+		return suffixArray32(suffixSort32(buf))
+	default:
+		return suffixArray64(suffixSort64(buf))
+	}
+}
@@ -0,0 +1,226 @@
+package bsdiff
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+)
+
+// Flags of a tar.gz patch.
+const (
+	// targzOld is set if the old file was decompressed.
+	targzOld = 1 << iota
+	// targzNew is set if the new file is recompressed.
+	targzNew
+	// targzExtra is set if the new file's gzip header has an extra field.
+	targzExtra
+)
+
+// gzipLevels are the compress/gzip levels tried when looking for the level
+// a file was compressed with, most common first.
+var gzipLevels = []int{gzip.DefaultCompression, gzip.BestCompression, gzip.BestSpeed, 2, 3, 4, 5, 7, 8, gzip.NoCompression, gzip.HuffmanOnly}
+
+// gunzip decompresses a gzip file, returning its header too.
+func gunzip(b []byte) ([]byte, *gzip.Header, bool) {
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, nil, false
+	}
+	data, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, nil, false
+	}
+	return data, &zr.Header, true
+}
+
+// gzipLevel finds the compress/gzip level that compresses data with hdr to
+// exactly want.
+func gzipLevel(data, want []byte, hdr *gzip.Header) (int, bool) {
+	for _, level := range gzipLevels {
+		mw := &matchWriter{want: want}
+		zw, err := gzip.NewWriterLevel(mw, level)
+		if err != nil {
+			continue
+		}
+		zw.Header = *hdr
+		if _, err := zw.Write(data); err != nil {
+			continue
+		}
+		if zw.Close() == nil && mw.n == len(want) {
+			return level, true
+		}
+	}
+	return 0, false
+}
+
+// tarSegment is a range of a tar stream.
+type tarSegment struct {
+	off, n int64
+}
+
+// tarMembers splits a tar stream into its members, each made of its
+// headers and padded data, and returns them with their names. The last
+// segment is what follows the final member. It returns nothing if data
+// can't be split.
+func tarMembers(data []byte) ([]tarSegment, []string) {
+	r := &countReader{r: bytes.NewReader(data)}
+	tr := tar.NewReader(r)
+	var segs []tarSegment
+	var names []string
+	var end int64
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		// Sparse files hold less data than their size
+		if err != nil || hdr.Typeflag == tar.TypeGNUSparse || hdr.Size < 0 {
+			return nil, nil
+		}
+		memberEnd := r.n + (hdr.Size+511)/512*512
+		if memberEnd > int64(len(data)) || memberEnd < end {
+			return nil, nil
+		}
+		segs = append(segs, tarSegment{end, memberEnd - end})
+		names = append(names, hdr.Name)
+		end = memberEnd
+	}
+	segs = append(segs, tarSegment{end, int64(len(data)) - end})
+	return segs, names
+}
+
+// countReader counts the bytes read from r.
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// matchTarMembers orders the members of the old tar stream like the
+// members of the same name in the new one, followed by the rest of the old
+// members in their order.
+func matchTarMembers(oldtar, newtar []byte) []tarSegment {
+	oldSegs, oldNames := tarMembers(oldtar)
+	_, newNames := tarMembers(newtar)
+	if oldSegs == nil || newNames == nil {
+		return []tarSegment{{0, int64(len(oldtar))}}
+	}
+	byName := map[string][]int{}
+	for i, name := range oldNames {
+		byName[name] = append(byName[name], i)
+	}
+	used := make([]bool, len(oldSegs))
+	var segs []tarSegment
+	for _, name := range newNames {
+		if idx := byName[name]; len(idx) > 0 {
+			byName[name] = idx[1:]
+			used[idx[0]] = true
+			segs = append(segs, oldSegs[idx[0]])
+		}
+	}
+	for i, seg := range oldSegs {
+		if !used[i] {
+			segs = append(segs, seg)
+		}
+	}
+	return segs
+}
+
+// TarGz generates a patch between two gzip-compressed files, usually
+// tarballs. See Differ.TarGz.
+func TarGz(oldtgz, newtgz []byte, opts ...Option) ([]byte, error) {
+	return New(opts...).TarGz(oldtgz, newtgz)
+}
+
+// TarGz generates a patch between two gzip-compressed files, usually
+// tarballs, that diffs their decompressed contents. Apply it with
+// bspatch.TarGz. With WithTarNameMatching the members of the old tar
+// stream are first reordered to match those of the new one.
+//
+// The patch records the new file's gzip header and the compress/gzip level
+// that recompresses it byte for byte. If no level does, as for files
+// compressed with the gzip command, the patch is a plain diff of the
+// compressed files.
+func (d *Differ) TarGz(oldtgz, newtgz []byte) ([]byte, error) {
+	// Tar.gz patch format:
+	// --- header ---
+	//  0 -  7 : "BSDIFFT1"
+	//  8 - 39 : sha256(new file)
+	// 40      : flags, targzOld | targzNew | targzExtra
+	// If the new file is recompressed:
+	//   1 byte: the compress/gzip level as an int8
+	//   1 byte: gzip header OS
+	//   uvarint: gzip header modification time, in seconds
+	//   uvarint length and bytes: gzip header name, comment and, with
+	//   targzExtra, extra field
+	// uvarint: number of segments of the old file
+	//   for each, uvarint offset and length in the decompressed old file
+	// ---  data  ---
+	// A bsdiff patch from the concatenated segments of the old file to the
+	// new file, decompressed if it is recompressed.
+	oldbs, newbs := oldtgz, newtgz
+	var flags byte
+	var level int
+	newtar, hdr, ok := gunzip(newtgz)
+	if ok {
+		level, ok = gzipLevel(newtar, newtgz, hdr)
+	}
+	if ok {
+		flags |= targzNew
+		newbs = newtar
+		if hdr.Extra != nil {
+			flags |= targzExtra
+		}
+		if oldtar, _, ok := gunzip(oldtgz); ok {
+			flags |= targzOld
+			oldbs = oldtar
+		}
+	}
+	segs := []tarSegment{{0, int64(len(oldbs))}}
+	if d.cfg.tarNameMatching && flags&targzNew != 0 {
+		segs = matchTarMembers(oldbs, newbs)
+	}
+
+	sum := sha256.Sum256(newtgz)
+	header := append([]byte("BSDIFFT1"), sum[:]...)
+	header = append(header, flags)
+	if flags&targzNew != 0 {
+		header = append(header, byte(int8(level)), hdr.OS)
+		var mtime int64
+		if !hdr.ModTime.IsZero() {
+			mtime = hdr.ModTime.Unix()
+		}
+		header = binary.AppendUvarint(header, uint64(mtime))
+		fields := []string{hdr.Name, hdr.Comment}
+		if flags&targzExtra != 0 {
+			fields = append(fields, string(hdr.Extra))
+		}
+		for _, s := range fields {
+			header = binary.AppendUvarint(header, uint64(len(s)))
+			header = append(header, s...)
+		}
+	}
+	header = binary.AppendUvarint(header, uint64(len(segs)))
+	var blob bytes.Buffer
+	for _, seg := range segs {
+		header = binary.AppendUvarint(header, uint64(seg.off))
+		header = binary.AppendUvarint(header, uint64(seg.n))
+		blob.Write(oldbs[seg.off : seg.off+seg.n])
+	}
+
+	patch, err := diffb(context.Background(), blob.Bytes(), newbs, d.cfg)
+	if err != nil {
+		return nil, err
+	}
+	return append(header, patch...), nil
+}
@@ -0,0 +1,110 @@
+package bsdiff
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kiteco/go-bsdiff/v2/pkg/bspatch"
+)
+
+// makeTarGz writes files to a tar stream compressed with compress/gzip at
+// level, flushing after every file if flush is set.
+func makeTarGz(t *testing.T, files []string, contents map[string]string, level int, flush bool) []byte {
+	buf := new(bytes.Buffer)
+	zw, err := gzip.NewWriterLevel(buf, level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw.Name = "release.tar"
+	zw.ModTime = time.Unix(1700000000, 0)
+	tw := tar.NewWriter(zw)
+	for _, name := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(contents[name]))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(contents[name])); err != nil {
+			t.Fatal(err)
+		}
+		if flush {
+			tw.Flush()
+			zw.Flush()
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestTarGz(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	contents := map[string]string{}
+	var files []string
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("usr/lib/lib%v.so", i)
+		var sb strings.Builder
+		for j := 0; j < 2000; j++ {
+			fmt.Fprintf(&sb, "symbol%v offset%v ", rnd.Intn(100), rnd.Intn(1000))
+		}
+		contents[name] = sb.String()
+		files = append(files, name)
+	}
+	oldtgz := makeTarGz(t, files, contents, gzip.DefaultCompression, false)
+
+	contents["usr/lib/lib3.so"] = strings.Replace(contents["usr/lib/lib3.so"], "symbol1", "symbol2", -1)
+	contents["usr/bin/added"] = contents["usr/lib/lib5.so"] + "added"
+	files = append([]string{"usr/bin/added"}, files...)
+	files[5], files[15] = files[15], files[5]
+	for _, level := range []int{gzip.DefaultCompression, gzip.BestCompression} {
+		newtgz := makeTarGz(t, files, contents, level, false)
+		raw, err := Bytes(oldtgz, newtgz)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, matching := range []bool{false, true} {
+			patch, err := TarGz(oldtgz, newtgz, WithTarNameMatching(matching))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(patch) >= len(raw)/2 {
+				t.Error("tar.gz patch is", len(patch), "bytes, raw patch", len(raw))
+			}
+			newtgz2, err := bspatch.TarGz(oldtgz, patch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(newtgz, newtgz2) {
+				t.Fatal("tar.gz patch does not reproduce the new file")
+			}
+		}
+
+	}
+
+	// Files compressed differently, and files that aren't gzip-compressed,
+	// are diffed as they are
+	for _, newbs := range [][]byte{makeTarGz(t, files, contents, gzip.DefaultCompression, true), []byte("not a gzip file")} {
+		patch, err := TarGz(oldtgz, newbs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if patch[40] != 0 {
+			t.Error("expected a raw diff, got flags", patch[40])
+		}
+		newbs2, err := bspatch.TarGz(oldtgz, patch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(newbs, newbs2) {
+			t.Fatal("raw tar.gz patch does not reproduce the new file")
+		}
+	}
+}
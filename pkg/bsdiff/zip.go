@@ -0,0 +1,193 @@
+package bsdiff
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+)
+
+// zipLevels are the compress/flate levels tried when looking for the level
+// an entry was compressed with, most common first.
+var zipLevels = []int{flate.DefaultCompression, 9, 1, 2, 3, 4, 5, 7, 8, flate.NoCompression, flate.HuffmanOnly}
+
+// zipEntry is a deflated entry of an archive.
+type zipEntry struct {
+	off, size int64
+	data      []byte
+	level     int
+}
+
+// deflatedEntries returns the deflated entries of archive that inflate
+// cleanly, in the order of their offsets. It returns none if archive is not
+// a zip file.
+func deflatedEntries(archive []byte) []zipEntry {
+	zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil && err != zip.ErrInsecurePath {
+		return nil
+	}
+	var entries []zipEntry
+	for _, f := range zr.File {
+		if f.Method != zip.Deflate {
+			continue
+		}
+		off, err := f.DataOffset()
+		size := int64(f.CompressedSize64)
+		if err != nil || size < 0 || off > int64(len(archive))-size {
+			continue
+		}
+		data, ok := inflateExactly(archive[off:off+size], f.UncompressedSize64)
+		if !ok {
+			continue
+		}
+		entries = append(entries, zipEntry{off: off, size: size, data: data})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].off < entries[j].off })
+	// Drop entries that overlap, which no sane archive has
+	var end int64
+	kept := entries[:0]
+	for _, e := range entries {
+		if e.off >= end {
+			kept = append(kept, e)
+			end = e.off + e.size
+		}
+	}
+	return kept
+}
+
+// inflateExactly inflates b, which must hold exactly one deflate stream of
+// size bytes.
+func inflateExactly(b []byte, size uint64) ([]byte, bool) {
+	br := bytes.NewReader(b)
+	fr := flate.NewReader(br)
+	defer fr.Close()
+	data := bytes.NewBuffer(make([]byte, 0, int(min(size, 64<<20))))
+	if n, err := io.Copy(data, io.LimitReader(fr, int64(size)+1)); err != nil || uint64(n) != size {
+		return nil, false
+	}
+	if br.Len() != 0 {
+		return nil, false
+	}
+	return data.Bytes(), true
+}
+
+var errMismatch = errors.New("recompressed data differs")
+
+// matchWriter fails as soon as what is written to it differs from want.
+type matchWriter struct {
+	want []byte
+	n    int
+}
+
+func (m *matchWriter) Write(p []byte) (int, error) {
+	if len(p) > len(m.want)-m.n || !bytes.Equal(p, m.want[m.n:m.n+len(p)]) {
+		return 0, errMismatch
+	}
+	m.n += len(p)
+	return len(p), nil
+}
+
+// deflateLevel finds the compress/flate level that compresses data to
+// exactly want.
+func deflateLevel(data, want []byte, writers map[int]*flate.Writer) (int, bool) {
+	for _, level := range zipLevels {
+		mw := &matchWriter{want: want}
+		fw := writers[level]
+		if fw == nil {
+			fw, _ = flate.NewWriter(mw, level)
+			writers[level] = fw
+		} else {
+			fw.Reset(mw)
+		}
+		if _, err := fw.Write(data); err != nil {
+			continue
+		}
+		if fw.Close() == nil && mw.n == len(want) {
+			return level, true
+		}
+	}
+	return 0, false
+}
+
+// expandEntries replaces the compressed data of each entry of archive with
+// its inflated data.
+func expandEntries(archive []byte, entries []zipEntry) []byte {
+	var out bytes.Buffer
+	var pos int64
+	for _, e := range entries {
+		out.Write(archive[pos:e.off])
+		out.Write(e.data)
+		pos = e.off + e.size
+	}
+	out.Write(archive[pos:])
+	return out.Bytes()
+}
+
+// Zip generates a patch between two zip archives (or jars, apks and other
+// zip-based formats). See Differ.Zip.
+func Zip(oldzip, newzip []byte, opts ...Option) ([]byte, error) {
+	return New(opts...).Zip(oldzip, newzip)
+}
+
+// Zip generates a patch between two zip archives that diffs the inflated
+// contents of their deflated entries, which is usually much smaller than a
+// patch between the compressed archives. Apply it with bspatch.Zip.
+//
+// bspatch recompresses each entry with compress/flate, so only entries this
+// reproduces byte for byte are inflated; those of archives written with
+// Go's archive/zip usually are, while those written with zlib are not.
+// Other entries are diffed as they are, so if none can be reproduced the
+// patch is a plain diff of the archives. Inputs that are not zip archives
+// are diffed as they are too.
+func (d *Differ) Zip(oldzip, newzip []byte) ([]byte, error) {
+	// Zip patch format:
+	// --- header ---
+	//  0 -  7 : "BSDIFFZ1"
+	//  8 - 39 : sha256(new archive)
+	// uvarint : number of inflated entries in the old archive
+	//   for each, uvarint offset and compressed size
+	// uvarint : number of inflated entries in the new archive
+	//   for each, uvarint offset, compressed size and inflated size and
+	//   1 byte, the compress/flate level as an int8
+	// ---  data  ---
+	// A bsdiff patch from the old archive to the new archive, both with
+	// their listed entries replaced by their inflated data.
+	var newEntries []zipEntry
+	writers := map[int]*flate.Writer{}
+	for _, e := range deflatedEntries(newzip) {
+		if level, ok := deflateLevel(e.data, newzip[e.off:e.off+e.size], writers); ok {
+			e.level = level
+			newEntries = append(newEntries, e)
+		}
+	}
+	var oldEntries []zipEntry
+	if len(newEntries) > 0 {
+		oldEntries = deflatedEntries(oldzip)
+	}
+
+	sum := sha256.Sum256(newzip)
+	header := append([]byte("BSDIFFZ1"), sum[:]...)
+	header = binary.AppendUvarint(header, uint64(len(oldEntries)))
+	for _, e := range oldEntries {
+		header = binary.AppendUvarint(header, uint64(e.off))
+		header = binary.AppendUvarint(header, uint64(e.size))
+	}
+	header = binary.AppendUvarint(header, uint64(len(newEntries)))
+	for _, e := range newEntries {
+		header = binary.AppendUvarint(header, uint64(e.off))
+		header = binary.AppendUvarint(header, uint64(e.size))
+		header = binary.AppendUvarint(header, uint64(len(e.data)))
+		header = append(header, byte(int8(e.level)))
+	}
+
+	patch, err := diffb(context.Background(), expandEntries(oldzip, oldEntries), expandEntries(newzip, newEntries), d.cfg)
+	if err != nil {
+		return nil, err
+	}
+	return append(header, patch...), nil
+}
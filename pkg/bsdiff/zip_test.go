@@ -0,0 +1,124 @@
+package bsdiff
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/kiteco/go-bsdiff/v2/pkg/bspatch"
+)
+
+// makeZip writes files to a zip archive, compressing them with compress if
+// it is not nil.
+func makeZip(t *testing.T, files []string, contents map[string]string, compress zip.Compressor) []byte {
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	if compress != nil {
+		zw.RegisterCompressor(zip.Deflate, compress)
+	}
+	for _, name := range files {
+		method := zip.Deflate
+		if strings.HasSuffix(name, ".png") {
+			method = zip.Store
+		}
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(contents[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// flushingWriter flushes after every write, so its output can't be
+// reproduced by compressing in one go.
+type flushingWriter struct {
+	*flate.Writer
+}
+
+func (w flushingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	if err == nil {
+		err = w.Flush()
+	}
+	return n, err
+}
+
+func TestZip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	contents := map[string]string{}
+	var files []string
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("com/example/Class%v.class", i)
+		var sb strings.Builder
+		for j := 0; j < 2000; j++ {
+			fmt.Fprintf(&sb, "method%v field%v ", rnd.Intn(100), rnd.Intn(1000))
+		}
+		contents[name] = sb.String()
+		files = append(files, name)
+	}
+	contents["icon.png"] = strings.Repeat("\x89PNG", 100)
+	files = append(files, "icon.png")
+	oldzip := makeZip(t, files, contents, nil)
+
+	contents["com/example/Class3.class"] = strings.Replace(contents["com/example/Class3.class"], "method1", "method2", -1)
+	contents["com/example/Added.class"] = contents["com/example/Class5.class"] + "added"
+	files = append([]string{"com/example/Added.class"}, files...)
+	best := func(w io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(w, flate.BestCompression)
+	}
+	for _, compress := range []zip.Compressor{nil, best} {
+		newzip := makeZip(t, files, contents, compress)
+		patch, err := Zip(oldzip, newzip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, err := Bytes(oldzip, newzip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(patch) >= len(raw)/2 {
+			t.Error("zip patch is", len(patch), "bytes, raw patch", len(raw))
+		}
+		newzip2, err := bspatch.Zip(oldzip, patch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(newzip, newzip2) {
+			t.Fatal("zip patch does not reproduce the new archive")
+		}
+	}
+
+	// Archives compressed differently, and files that aren't archives, are
+	// diffed as they are
+	flushing := func(w io.Writer) (io.WriteCloser, error) {
+		fw, err := flate.NewWriter(w, flate.DefaultCompression)
+		return flushingWriter{fw}, err
+	}
+	for _, newbs := range [][]byte{makeZip(t, files, contents, flushing), []byte("not a zip file")} {
+		patch, err := Zip(oldzip, newbs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if patch[40] != 0 || patch[41] != 0 {
+			t.Error("expected a raw diff, got", patch[:42])
+		}
+		newbs2, err := bspatch.Zip(oldzip, patch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(newbs, newbs2) {
+			t.Fatal("raw zip patch does not reproduce the new file")
+		}
+	}
+}
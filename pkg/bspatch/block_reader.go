@@ -0,0 +1,47 @@
+package bspatch
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// blockReader reads one compressed block of a patch and keeps track of the
+// position reached, so errors can say where in the patch they occurred.
+// It may be read by a readAhead goroutine while wrap is called.
+type blockReader struct {
+	name string
+	mu   sync.Mutex
+	r    *io.SectionReader
+	// off is the offset of the block in the patch.
+	off int64
+	// n is the number of bytes read so far.
+	n int64
+	// truncated is set if the patch ended before the block did.
+	truncated bool
+}
+
+func newBlockReader(name string, patch io.ReaderAt, off, n int64) *blockReader {
+	return &blockReader{name: name, r: io.NewSectionReader(patch, off, n), off: off}
+}
+
+func (b *blockReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.n += int64(n)
+	if err == io.EOF && b.n < b.r.Size() {
+		b.truncated = true
+	}
+	return n, err
+}
+
+// wrap returns err as a BlockError for this block.
+func (b *blockReader) wrap(err error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.truncated {
+		err = fmt.Errorf("%w: %w", ErrTruncated, err)
+	}
+	return BlockError{b.name, b.off + b.n, err}
+}
@@ -28,74 +28,53 @@ package bspatch
 import (
 	"bufio"
 	"bytes"
-	"crypto/sha256"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"os"
+	"math"
 
-	"github.com/dsnet/compress/bzip2"
-	"github.com/kiteco/go-bsdiff/v2/pkg/util"
-)
-
-// Variables for streaming
-var (
-	writeBufferSize = 1024 * 1024
-	copyBufferSize  = 1024 * 1024
+	"github.com/kiteco/go-bsdiff/v2/pkg/codec"
+	"github.com/kiteco/go-bsdiff/v2/pkg/filter"
 )
 
 // Bytes applies a patch with the oldfile to create the newfile
-func Bytes(oldfile, patch []byte) (newfile []byte, err error) {
-	return patchb(oldfile, patch)
+func Bytes(oldfile, patch []byte, opts ...Option) (newfile []byte, err error) {
+	return New(opts...).Bytes(oldfile, patch)
 }
 
-// Reader applies a BSDIFF4 patch (using oldbin and patchf) to create the newbin
-func Reader(oldbin io.Reader, newbin io.Writer, patchf io.Reader) error {
-	oldbs, err := ioutil.ReadAll(oldbin)
-	if err != nil {
-		return err
-	}
-	diffbytes, err := ioutil.ReadAll(patchf)
-	if err != nil {
-		return err
-	}
-	newbs, err := patchb(oldbs, diffbytes)
-	if err != nil {
-		return err
-	}
-	return util.PutWriter(newbin, newbs)
+// Reader applies a BSDIFF4 patch (using oldbin and patchf) to create the newbin.
+// If oldbin implements io.Seeker and patchf implements io.ReaderAt they are
+// streamed; otherwise they are read into memory first.
+func Reader(oldbin io.Reader, newbin io.Writer, patchf io.Reader, opts ...Option) error {
+	return New(opts...).Reader(oldbin, newbin, patchf)
 }
 
-// File applies a BSDIFF4 patch (using oldfile and patchfile) to create the newfile
-func File(oldfile, newfile, patchfile string) error {
-	oldf, err := os.Open(oldfile)
-	if err != nil {
-		return fmt.Errorf("could not open oldfile '%s': %v", oldfile, err)
-	}
-	defer oldf.Close()
-
-	newf, err := os.Create(newfile)
-	if err != nil {
-		return fmt.Errorf("could not open or create newfile '%s': %v", newfile, err)
-	}
-
-	patchbs, err := ioutil.ReadFile(patchfile)
-	if err != nil {
-		return fmt.Errorf("could not read patchfile '%s': %v", patchfile, err)
-	}
+// Apply applies a BSDIFF4 patch (using old and patch) to create new, streaming
+// all three. Memory use is bounded by the buffer sizes, not the file sizes.
+// The diff and extra blocks are read through concurrent ReadAt calls
+// unless read-ahead is turned off with WithReadAhead(0). Patches made with
+// bsdiff.WithELFFilter read the whole old file into memory.
+func Apply(old io.ReadSeeker, new io.Writer, patch io.ReaderAt, opts ...Option) error {
+	return New(opts...).Apply(old, new, patch)
+}
 
-	newfw := bufio.NewWriterSize(newf, writeBufferSize)
-	err = patchStream(oldf, newfw, patchbs)
+// PatchContext is like Apply but returns ctx.Err() if ctx is done before the
+// patch has been applied. new may have been partially written by then.
+func PatchContext(ctx context.Context, old io.ReadSeeker, new io.Writer, patch io.ReaderAt, opts ...Option) error {
+	return New(opts...).PatchContext(ctx, old, new, patch)
+}
 
-	if err != nil {
-		newf.Close()
-		os.Remove(newfile)
-		return fmt.Errorf("bspatch: %v", err)
-	}
+// Validate checks that patch applies cleanly to old without writing the new
+// file anywhere. It returns the same errors as Apply.
+func Validate(old io.ReadSeeker, patch io.ReaderAt, opts ...Option) error {
+	return New(opts...).Validate(old, patch)
+}
 
-	newfw.Flush()
-	newf.Close()
-	return nil
+// File applies a BSDIFF4 patch (using oldfile and patchfile) to create the newfile
+func File(oldfile, newfile, patchfile string, opts ...Option) error {
+	return New(opts...).File(oldfile, newfile, patchfile)
 }
 
 type ctrlTriple [3]int64
@@ -106,7 +85,10 @@ func (c *ctrlTriple) copy() int64 { return c[1] }
 
 func (c *ctrlTriple) seek() int64 { return c[2] }
 
-func patchStream(oldf io.ReadSeeker, newf io.Writer, patch []byte) error {
+// patchStream applies patch to oldf, writing the result to newf. If ck is
+// not nil, it starts from ck.start, if set, and saves checkpoints as it
+// goes.
+func patchStream(ctx context.Context, oldf io.ReadSeeker, newf io.Writer, patch io.ReaderAt, cfg *config, ck *checkpointer) error {
 	// File format:
 	// --- header ---
 	//  0     -  7       : "BSDIFF40"
@@ -118,6 +100,12 @@ func patchStream(oldf io.ReadSeeker, newf io.Writer, patch []byte) error {
 	// 64     - 64+X-1   : bzip2(control block)
 	// 64+X   - 64+X+Y-1 : bzip2(diff block)
 	// 64+X+Y - ??       : bzip2(extra block)
+	//
+	// The upstream (classic) format has no checksum, so its header is 32
+	// bytes long and the blocks start at offset 32. The extended format
+	// ("BSDIFFX1") stores the codec of each block at bytes 32-34, the
+	// checksum algorithm at 35, the filter at 36 and the D-byte checksums
+	// of the old and new files from 40, so its blocks start at offset 40+2D.
 
 	//  The control block contains sets of triples (x,y,z) meaning:
 	//  a) add x bytes from old file to x bytes from the diff block and copy
@@ -125,135 +113,297 @@ func patchStream(oldf io.ReadSeeker, newf io.Writer, patch []byte) error {
 	//  c) seek in the oldfile by z bytes
 	//  Note that z can be negative.
 
-	const headerLen int64 = 64
-
-	cpBuf := make([]byte, copyBufferSize)
+	cpBuf := make([]byte, cfg.copyBufferSize())
 
 	// Reused container vars
 	var lenread int64
-	var errmsg string
-	header := make([]byte, headerLen)
 	hdbuf := make([]byte, 8)
 	var ctrip ctrlTriple
 
-	// Counter used for sanity checks
-	newfwc := newWriteCounter(newf)
-
 	// Read the patch header
-	p := bytes.NewReader(patch)
-	// bytes.Reader always reads as much as possible
-	n, err := p.Read(header)
+	h, err := readHeader(patch)
+	if err != nil {
+		return err
+	}
 
+	// Hash the output as it's written if the patch records its checksum
+	newsum, err := h.sumAlg.New()
 	if err != nil {
-		return newCorruptPatchError(err.Error())
+		return err
 	}
-	if int64(n) < headerLen {
-		errmsg = fmt.Sprintf("short header read (n %v < %v)", n, headerLen)
-		return newCorruptPatchError(errmsg)
+	if h.newSum != nil {
+		newf = io.MultiWriter(newf, newsum)
+	}
+	if ck != nil && h.filter != filter.None {
+		return errors.New("filtered patches can't be checkpointed")
+	}
+	// The blocks make the filtered new file, which is unfiltered as it's
+	// written
+	var unfilter io.WriteCloser
+	if h.filter != filter.None {
+		unfilter = h.filter.NewDecoder(newf)
+		newf = unfilter
 	}
 
-	// Check for appropriate magic
-	if bytes.Compare(header[:8], []byte("BSDIFF40")) != 0 {
-		return newCorruptPatchError("incorrect magic number (header BSDIFF40)")
+	// Counter used for sanity checks
+	newfwc := newWriteCounter(newf)
+
+	// The old file's size bounds the control triples
+	oldsize, err := oldf.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("could not seek oldfile: %w", err)
+	}
+	if _, err := oldf.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("could not seek oldfile: %w", err)
 	}
+	var oldpos int64
+	var ntrip int64
 
 	// check input file checksum
-	expectedSum := header[32:]
-	sum := sha256.New()
-	if _, err := io.CopyBuffer(sum, oldf, cpBuf); err != nil {
-		return err
-	}
-	actualSum := sum.Sum(nil)
-	if !bytes.Equal(expectedSum, actualSum) {
-		return fmt.Errorf("Invalid input checksum: expected % x, but got % x", expectedSum, actualSum)
+	if h.oldSum != nil {
+		expectedSum := h.oldSum
+		sum, err := h.sumAlg.New()
+		if err != nil {
+			return err
+		}
+		if _, err := io.CopyBuffer(sum, oldf, cpBuf); err != nil {
+			return err
+		}
+		actualSum := sum.Sum(nil)
+		if !bytes.Equal(expectedSum, actualSum) {
+			return newChecksumError("oldfile", expectedSum, actualSum)
+		}
+		if _, err := oldf.Seek(0, io.SeekStart); err != nil { // reset oldf
+			return err
+		}
 	}
-	oldf.Seek(0, io.SeekStart) // reset oldf
-
-	// Read lengths from header
-	bzctrllen := offtin(header[8:])
-	bzdatalen := offtin(header[16:])
-	newsize := offtin(header[24:])
-	if bzctrllen < 0 || bzdatalen < 0 || newsize < 0 {
-		errmsg = fmt.Sprintf("negative length block(s) read from header (bzctrllen %v bzdatalen %v newsize %v)", bzctrllen, bzdatalen, newsize)
-		return newCorruptPatchError(errmsg)
+
+	// The filter needs the whole old file, and a filtered copy of it
+	if h.filter != filter.None {
+		var src io.Reader = oldf
+		if cfg.memLimit > 0 {
+			src = io.LimitReader(oldf, cfg.memLimit/2+1)
+		}
+		oldbs, err := ioutil.ReadAll(src)
+		if err != nil {
+			return err
+		}
+		if cfg.memLimit > 0 && 2*int64(len(oldbs)) > cfg.memLimit {
+			return fmt.Errorf("filtered patch needs the old file twice in memory: %w", ErrMemoryLimit)
+		}
+		oldf = bytes.NewReader(h.filter.Encode(oldbs))
 	}
 
-	// Close patch file and re-open it via libbzip2 at the right places
-	p = nil
-	ctrlbz := bytes.NewReader(patch)
-	if _, err := ctrlbz.Seek(headerLen, io.SeekStart); err != nil {
-		return err
+	bzctrllen := h.ctrlLen
+	bzdatalen := h.diffLen
+	newsize := h.newSize
+
+	// Read each block through its own section of the patch, so nothing but
+	// the decompressor state is held in memory
+	var decomp [3]codec.Codec
+	for i, id := range h.codecs {
+		if decomp[i], err = codec.Get(id); err != nil {
+			return newCorruptPatchError(err.Error())
+		}
 	}
-	ctrl, err := bzip2.NewReader(ctrlbz, nil)
+	xtraoff := h.dataOff + bzctrllen + bzdatalen
+	ctrlbz := newBlockReader("ctrl", patch, h.dataOff, bzctrllen)
+	ctrl, err := decomp[0].NewReader(ctrlbz)
 	if err != nil {
-		return err
+		return ctrlbz.wrap(err)
 	}
-	databz := bytes.NewReader(patch)
-	if _, err := databz.Seek(headerLen+bzctrllen, io.SeekStart); err != nil {
-		return err
-	}
-	data, err := bzip2.NewReader(databz, nil)
+	databz := newBlockReader("diff", patch, h.dataOff+bzctrllen, bzdatalen)
+	data, err := decomp[1].NewReader(databz)
 	if err != nil {
-		return err
-	}
-	xtrabz := bytes.NewReader(patch)
-	if _, err := xtrabz.Seek(headerLen+bzctrllen+bzdatalen, io.SeekStart); err != nil {
-		return err
+		return databz.wrap(err)
 	}
-	xtra, err := bzip2.NewReader(xtrabz, nil)
+	xtrabz := newBlockReader("extra", patch, xtraoff, math.MaxInt64-xtraoff)
+	xtra, err := decomp[2].NewReader(xtrabz)
 	if err != nil {
-		return err
+		return xtrabz.wrap(err)
 	}
 
+	if n := cfg.readAheadSize(); n > 0 {
+		data = newReadAhead(data, n)
+		xtra = newReadAhead(xtra, n)
+	}
+	defer func() {
+		// Stop the read-ahead goroutines if patching fails
+		if data != nil {
+			data.Close()
+		}
+		if xtra != nil {
+			xtra.Close()
+		}
+	}()
+
 	xbyteadd := newByteAddReader(data, oldf)
 
+	// Writes to the new file go through cw, which stops the copies below
+	// once ctx is done
+	cw := &contextWriter{ctx, newfwc, newsize, cfg.progress}
+
+	// The current triple started at these positions in the new file and
+	// the diff and extra blocks
+	var tripNew, diffpos, extrapos int64
+	var resume *checkpoint
+	if ck != nil && ck.start != nil {
+		// Pick up from the checkpoint: the new file already holds what was
+		// written before it, and the blocks are decompressed again up to it
+		resume = ck.start
+		if _, err := io.CopyN(ioutil.Discard, ctrl, 24*resume.triple); err != nil {
+			return ctrlbz.wrap(newCorruptPatchBzEndError(0, 24*resume.triple, "control data", err))
+		}
+		ntrip, oldpos = resume.triple, resume.oldpos
+		diffpos, extrapos = resume.diffpos, resume.extrapos
+		newfwc.n = resume.newpos + resume.done
+		if h.newSum != nil {
+			if _, err := io.Copy(newsum, io.NewSectionReader(ck.written, 0, newfwc.n)); err != nil {
+				return err
+			}
+		}
+	}
+
+	// copyN copies n bytes from r to the new file, saving a checkpoint
+	// whenever one is due. An error saving it is returned as ckErr, so it
+	// isn't mistaken for a damaged block.
+	var ckErr error
+	copyN := func(r io.Reader, n int64) (int64, error) {
+		if ck == nil {
+			return io.CopyBuffer(cw, io.LimitReader(r, n), cpBuf)
+		}
+		var copied int64
+		for copied < n {
+			part := n - copied
+			if due := ck.next - newfwc.Count(); due < part {
+				part = due
+			}
+			m, err := io.CopyBuffer(cw, io.LimitReader(r, part), cpBuf)
+			copied += m
+			if err != nil || m < part {
+				return copied, err
+			}
+			if newfwc.Count() >= ck.next {
+				c := checkpoint{ntrip - 1, tripNew, oldpos, diffpos, extrapos, newfwc.Count() - tripNew}
+				if ckErr = ck.save(c); ckErr != nil {
+					return copied, ckErr
+				}
+				ck.next = newfwc.Count() + ck.interval
+			}
+		}
+		return copied, nil
+	}
+	if ck != nil {
+		ck.next = newfwc.Count() + ck.interval
+	}
+
 	for newfwc.Count() < newsize {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		// Read control data
 		for i := 0; i < 3; i++ {
 			lenread, err := io.ReadFull(ctrl, hdbuf)
 			if lenread != 8 || (err != nil && err != io.EOF) {
 				// format "corrupt patch or bz stream ended: control data read (lenread/8) err.Error()"
-				return newCorruptPatchBzEndError(int64(lenread), 8, "control data", err)
+				return ctrlbz.wrap(newCorruptPatchBzEndError(int64(lenread), 8, "control data", err))
 			}
 			ctrip[i] = offtin(hdbuf)
 		}
 
-		if newfwc.Count()+ctrip.sum() > newsize {
-			return newCorruptPatchError("newfile pos + data block exceeds expected newfile size")
+		tripNew = newfwc.Count()
+		var xdone, ydone int64
+		if resume != nil {
+			tripNew = resume.newpos
+		}
+		if err := ctrip.check(ntrip, tripNew, newsize, oldpos, oldsize); err != nil {
+			return err
+		}
+		ntrip++
+		if resume != nil {
+			if resume.done > ctrip.sum()+ctrip.copy() {
+				return errStaleCheckpoint
+			}
+			xdone = min64(resume.done, ctrip.sum())
+			ydone = resume.done - xdone
+			if _, err := io.CopyN(ioutil.Discard, data, diffpos+xdone); err != nil {
+				return databz.wrap(newCorruptPatchBzEndError(0, diffpos+xdone, "x data block", err))
+			}
+			if _, err := io.CopyN(ioutil.Discard, xtra, extrapos+ydone); err != nil {
+				return xtrabz.wrap(newCorruptPatchBzEndError(0, extrapos+ydone, "y extra block", err))
+			}
+			if _, err := oldf.Seek(oldpos+xdone, io.SeekStart); err != nil {
+				return fmt.Errorf("could not seek oldfile: %w", err)
+			}
+			resume = nil
 		}
 
 		// Read x bytes from diff + old into new file
-		lenread, err = io.CopyBuffer(newfwc, io.LimitReader(xbyteadd, ctrip.sum()), cpBuf)
-		if lenread < ctrip.sum() || (err != nil && err != io.EOF) {
-			return newCorruptPatchBzEndError(lenread, ctrip.sum(), "x data block", err)
+		lenread, err = copyN(xbyteadd, ctrip.sum()-xdone)
+		if ckErr != nil {
+			return ckErr
 		}
-
-		if newfwc.Count()+ctrip.copy() > newsize {
-			return newCorruptPatchError("newfile pos + extra block exceeds expected newfile size")
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if lenread < ctrip.sum()-xdone || (err != nil && err != io.EOF) {
+			return databz.wrap(newCorruptPatchBzEndError(xdone+lenread, ctrip.sum(), "x data block", err))
 		}
 
 		// Read bytes from the extra block into the new file
-		lenread, err = io.CopyBuffer(newfwc, io.LimitReader(xtra, ctrip.copy()), cpBuf)
-		if lenread < ctrip.copy() || (err != nil && err != io.EOF) {
-			return newCorruptPatchBzEndError(lenread, ctrip.copy(), "y extra block", err)
+		lenread, err = copyN(xtra, ctrip.copy()-ydone)
+		if ckErr != nil {
+			return ckErr
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if lenread < ctrip.copy()-ydone || (err != nil && err != io.EOF) {
+			return xtrabz.wrap(newCorruptPatchBzEndError(ydone+lenread, ctrip.copy(), "y extra block", err))
 		}
 
 		// Adjust oldfile offset by ctrl triple
+		oldpos += ctrip.sum() + ctrip.seek()
+		diffpos += ctrip.sum()
+		extrapos += ctrip.copy()
 		_, err = oldf.Seek(ctrip.seek(), io.SeekCurrent)
 		if err != nil {
-			return err
+			return fmt.Errorf("could not seek oldfile: %w", err)
+		}
+	}
+
+	if newfwc.Count() != newsize {
+		errmsg := fmt.Sprintf("newfile size %v does not match expected size %v", newfwc.Count(), newsize)
+		return newCorruptPatchError(errmsg)
+	}
+
+	// Read the blocks to the end, so a truncated or damaged stream trailer
+	// is reported even though no more output is needed. The control triples
+	// must have used all of the blocks.
+	for _, b := range []struct {
+		r  io.Reader
+		br *blockReader
+	}{{ctrl, ctrlbz}, {data, databz}, {xtra, xtrabz}} {
+		n, err := io.Copy(ioutil.Discard, b.r)
+		if err != nil {
+			return b.br.wrap(err)
+		}
+		if n != 0 {
+			errmsg := fmt.Sprintf("%v unused bytes at the end of the %s block", n, b.br.name)
+			return b.br.wrap(newCorruptPatchError(errmsg))
 		}
 	}
 
 	// Clean up the bzip2 reads
 	if err = ctrl.Close(); err != nil {
-		return err
+		return ctrlbz.wrap(err)
 	}
 	if err = data.Close(); err != nil {
-		return err
+		return databz.wrap(err)
 	}
 	if err = xtra.Close(); err != nil {
-		return err
+		return xtrabz.wrap(err)
 	}
 	ctrlbz = nil
 	databz = nil
@@ -262,15 +412,64 @@ func patchStream(oldf io.ReadSeeker, newf io.Writer, patch []byte) error {
 	data = nil
 	xtra = nil
 
+	if unfilter != nil {
+		if err := unfilter.Close(); err != nil {
+			return err
+		}
+	}
+
+	// check output file checksum
+	if h.newSum != nil {
+		if actualSum := newsum.Sum(nil); !bytes.Equal(h.newSum, actualSum) {
+			return newChecksumError("newfile", h.newSum, actualSum)
+		}
+	}
+
 	return nil
 }
 
-func patchb(oldfile, patch []byte) ([]byte, error) {
+// check validates the i-th control triple of a patch, which is applied with
+// the new file at newpos and the old file at oldpos. The triple must stay
+// within both files; an oldsize < 0 skips the checks against the old file.
+//
+// bsdiff emits a triple at most once per byte of the new file, plus one at
+// its end, so a patch with more triples than that is rejected rather than
+// spinning through triples that produce no output.
+func (c *ctrlTriple) check(i, newpos, newsize, oldpos, oldsize int64) error {
+	switch {
+	case i > newsize:
+		return newCorruptTripleError(i, "more control triples than newfile bytes")
+	case c.sum() < 0 || c.copy() < 0:
+		return newCorruptTripleError(i, fmt.Sprintf("negative block length (x %v y %v)", c.sum(), c.copy()))
+	case c.sum() > newsize-newpos:
+		return newCorruptTripleError(i, "newfile pos + data block exceeds expected newfile size")
+	case c.copy() > newsize-newpos-c.sum():
+		return newCorruptTripleError(i, "newfile pos + extra block exceeds expected newfile size")
+	case oldsize < 0:
+		return nil
+	case c.sum() > oldsize-oldpos:
+		return newCorruptTripleError(i, "oldfile pos + data block exceeds oldfile size")
+	case c.seek() < -(oldpos+c.sum()) || c.seek() > oldsize-oldpos-c.sum():
+		return newCorruptTripleError(i, fmt.Sprintf("oldfile seek by %v leaves oldfile", c.seek()))
+	}
+	return nil
+}
+
+func patchb(oldfile, patch []byte, cfg *config) ([]byte, error) {
+	if cfg.memLimit > 0 {
+		h, err := readHeader(bytes.NewReader(patch))
+		if err != nil {
+			return nil, err
+		}
+		if h.newSize > cfg.memLimit {
+			return nil, ErrMemoryLimit
+		}
+	}
 	newfby := new(bytes.Buffer)
 	// Use bufio here to emulate File()'s use of bufio for testing
-	newfbuf := bufio.NewWriterSize(newfby, writeBufferSize)
+	newfbuf := bufio.NewWriterSize(newfby, cfg.writeBufferSize())
 	oldfby := bytes.NewReader(oldfile)
-	err := patchStream(oldfby, newfbuf, patch)
+	err := patchStream(context.Background(), oldfby, newfbuf, bytes.NewReader(patch), cfg, nil)
 	newfbuf.Flush()
 	return newfby.Bytes(), err
 }
@@ -300,6 +499,13 @@ func offtin(buf []byte) int64 {
 	return int64(y)
 }
 
+func min64(a, b int64) int64 {
+	if a > b {
+		return b
+	}
+	return a
+}
+
 func min(a, b int) int {
 	if a > b {
 		return b
@@ -2,12 +2,22 @@ package bspatch
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
 
+	"github.com/kiteco/go-bsdiff/v2/pkg/bsdiff"
+	"github.com/kiteco/go-bsdiff/v2/pkg/codec"
 	"github.com/kiteco/go-bsdiff/v2/pkg/util"
 )
 
@@ -70,11 +80,9 @@ func TestPatch(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		writeBufferSize = test.wbufsz
-		copyBufferSize = test.cpbufsz
-
-		desc := fmt.Sprintf("writeBufferSize: %v, copyBufferSize: %v", writeBufferSize, copyBufferSize)
-		newfile, err := Bytes(oldfile, patchfile)
+		desc := fmt.Sprintf("writeBufferSize: %v, copyBufferSize: %v", test.wbufsz, test.cpbufsz)
+		p := New(WithWriteBufferSize(test.wbufsz), WithCopyBufferSize(test.cpbufsz))
+		newfile, err := p.Bytes(oldfile, patchfile)
 		if err != nil {
 			t.Errorf("With %s failed with error: %s", desc, err.Error())
 			continue
@@ -264,3 +272,452 @@ func (r *lowcaprdr) Read(b []byte) (int, error) {
 	r.n += len(b)
 	return len(b), nil
 }
+
+// readerAtOnly hides every method but ReadAt, so Apply can't fall back to
+// reading the patch sequentially.
+type readerAtOnly struct {
+	ra    io.ReaderAt
+	reads int64
+}
+
+func (r *readerAtOnly) ReadAt(p []byte, off int64) (int, error) {
+	atomic.AddInt64(&r.reads, 1)
+	return r.ra.ReadAt(p, off)
+}
+
+func TestNewFileChecksum(t *testing.T) {
+	oldbs := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog "), 50)
+	newbs := bytes.Replace(oldbs, []byte("fox"), []byte("cat"), 7)
+	patch, err := bsdiff.Bytes(oldbs, newbs, bsdiff.WithFormat(bsdiff.FormatExtended))
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch[72] ^= 0xFF
+	if _, err := Bytes(oldbs, patch); err == nil {
+		t.Fatal("newfile checksum should not match")
+	} else if cerr, ok := err.(ChecksumError); !ok || cerr.Name != "newfile" {
+		t.Fatal("expected newfile ChecksumError, got", err)
+	}
+
+	dir, err := ioutil.TempDir("", "bsdiff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldname := filepath.Join(dir, "old")
+	newname := filepath.Join(dir, "new")
+	patchname := filepath.Join(dir, "patch")
+	if err := ioutil.WriteFile(oldname, oldbs, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(patchname, patch, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := File(oldname, newname, patchname); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatal("expected ErrChecksumMismatch, got", err)
+	}
+	if _, err := os.Stat(newname); !os.IsNotExist(err) {
+		t.Fatal("partial newfile was not removed")
+	}
+}
+
+func TestApply(t *testing.T) {
+	patch := &readerAtOnly{ra: bytes.NewReader(patchfile)}
+	newf := new(bytes.Buffer)
+	if err := Apply(bytes.NewReader(oldfile), newf, patch); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(newf.Bytes(), newfilecomp) {
+		t.Fatalf("expected: %v, got: %v", newfilecomp, newf.Bytes())
+	}
+	if patch.reads == 0 {
+		t.Fatal("patch was not read through ReadAt")
+	}
+
+	// block lengths that overflow the patch offsets
+	corrupt := append([]byte{}, patchfile...)
+	copy(corrupt[8:], []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x7F})
+	copy(corrupt[16:], []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x7F})
+	err := Apply(bytes.NewReader(oldfile), new(bytes.Buffer), bytes.NewReader(corrupt))
+	if _, ok := err.(CorruptPatchError); !ok {
+		t.Fatal("expected CorruptPatchError, got", err)
+	}
+}
+
+func TestClassicGolden(t *testing.T) {
+	patches, err := filepath.Glob(filepath.Join("testdata", "classic", "*.patch"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(patches) == 0 {
+		t.Fatal("no golden patches found")
+	}
+	for _, patchname := range patches {
+		base := strings.TrimSuffix(patchname, ".patch")
+		oldbs, err := ioutil.ReadFile(base + ".old")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, err := ioutil.ReadFile(base + ".new")
+		if err != nil {
+			t.Fatal(err)
+		}
+		patch, err := ioutil.ReadFile(patchname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, err := readHeader(bytes.NewReader(patch))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.format != formatClassic {
+			t.Errorf("%s: not detected as classic format", patchname)
+		}
+		newbs, err := Bytes(oldbs, patch)
+		if err != nil {
+			t.Errorf("%s: %v", patchname, err)
+			continue
+		}
+		if !bytes.Equal(newbs, expected) {
+			t.Errorf("%s: output differs from %s.new", patchname, base)
+		}
+	}
+}
+
+func TestChecksummedHeader(t *testing.T) {
+	h, err := readHeader(bytes.NewReader(patchfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.format != formatChecksummed || h.dataOff != 64 || len(h.oldSum) != 32 {
+		t.Fatalf("unexpected header %+v", h)
+	}
+}
+
+func TestUnknownCodec(t *testing.T) {
+	// an extended header naming a codec that isn't registered
+	patch := make([]byte, 104)
+	copy(patch, "BSDIFFX1")
+	patch[32], patch[33], patch[34] = 1, 1, 250
+	copy(patch[40:], sha256Sum(oldfile))
+	_, err := Bytes(oldfile, patch)
+	if _, ok := err.(CorruptPatchError); !ok {
+		t.Fatal("expected CorruptPatchError, got", err)
+	}
+}
+
+func TestUnknownFilter(t *testing.T) {
+	patch := make([]byte, 104)
+	copy(patch, "BSDIFFX1")
+	patch[36] = 200
+	copy(patch[40:], sha256Sum(oldfile))
+	_, err := Bytes(oldfile, patch)
+	if _, ok := err.(CorruptPatchError); !ok {
+		t.Fatal("expected CorruptPatchError, got", err)
+	}
+}
+
+func sha256Sum(b []byte) []byte {
+	sum := sha256.Sum256(b)
+	return sum[:]
+}
+
+func TestPatchContext(t *testing.T) {
+	var calls int
+	var last int64
+	progress := func(done, total int64) {
+		calls++
+		if done < last || total != int64(len(newfilecomp)) {
+			t.Errorf("unexpected progress %v/%v", done, total)
+		}
+		last = done
+	}
+	newf := new(bytes.Buffer)
+	err := PatchContext(context.Background(), bytes.NewReader(oldfile), newf, bytes.NewReader(patchfile), WithProgress(progress))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(newf.Bytes(), newfilecomp) {
+		t.Fatalf("expected: %v, got: %v", newfilecomp, newf.Bytes())
+	}
+	if calls == 0 || last != int64(len(newfilecomp)) {
+		t.Fatalf("progress not reported to the end (%v calls, last %v)", calls, last)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = PatchContext(ctx, bytes.NewReader(oldfile), new(bytes.Buffer), bytes.NewReader(patchfile))
+	if err != context.Canceled {
+		t.Fatal("expected context.Canceled, got", err)
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	c := newConfig([]Option{WithMemoryLimit(64)})
+	if n := c.writeBufferSize(); n != 32 {
+		t.Errorf("writeBufferSize() = %v, want 32", n)
+	}
+	if n := c.copyBufferSize(); n != 32 {
+		t.Errorf("copyBufferSize() = %v, want 32", n)
+	}
+	c = newConfig([]Option{WithWriteBufferSize(8), WithCopyBufferSize(8), WithMemoryLimit(64)})
+	if n := c.writeBufferSize(); n != 8 {
+		t.Errorf("writeBufferSize() = %v, want 8", n)
+	}
+	if n := c.readAheadSize(); n != 0 {
+		t.Errorf("readAheadSize() = %v, want 0", n)
+	}
+
+	p := New(WithMemoryLimit(1))
+	newf := new(bytes.Buffer)
+	if err := p.Apply(bytes.NewReader(oldfile), newf, bytes.NewReader(patchfile)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(newf.Bytes(), newfilecomp) {
+		t.Fatal("new files are different")
+	}
+	// Bytes holds the whole new file in memory
+	if _, err := p.Bytes(oldfile, patchfile); err != ErrMemoryLimit {
+		t.Fatal("expected ErrMemoryLimit, got", err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	// the wrong old file
+	wrongold := append([]byte{}, oldfile...)
+	wrongold[0] ^= 0xFF
+	_, err := Bytes(wrongold, patchfile)
+	var cerr ChecksumError
+	if !errors.Is(err, ErrChecksumMismatch) || !errors.As(err, &cerr) || cerr.Name != "oldfile" {
+		t.Fatal("expected oldfile ChecksumError, got", err)
+	}
+	if !bytes.Equal(cerr.Expected, patchfile[32:64]) || !bytes.Equal(cerr.Actual, sha256Sum(wrongold)) {
+		t.Fatal("unexpected digests", cerr)
+	}
+
+	// not a patch
+	if _, err := Bytes(oldfile, oldfile); !errors.Is(err, ErrBadMagic) {
+		t.Fatal("expected ErrBadMagic, got", err)
+	}
+
+	// an interrupted download, cut anywhere
+	for n := 0; n < len(patchfile); n++ {
+		_, err := Bytes(oldfile, patchfile[:n])
+		if !errors.Is(err, ErrTruncated) {
+			t.Fatalf("patch cut at %v: expected ErrTruncated, got %v", n, err)
+		}
+		var berr BlockError
+		if n > checksummedHeaderLen && !errors.As(err, &berr) {
+			t.Fatalf("patch cut at %v: expected BlockError, got %v", n, err)
+		}
+	}
+
+	// a damaged control block
+	corrupt := append([]byte{}, patchfile...)
+	corrupt[checksummedHeaderLen] = 'X'
+	_, err = Bytes(oldfile, corrupt)
+	var berr BlockError
+	if !errors.As(err, &berr) || berr.Block != "ctrl" || berr.Offset < checksummedHeaderLen {
+		t.Fatal("expected ctrl BlockError, got", err)
+	}
+	if errors.Is(err, ErrTruncated) {
+		t.Fatal("damaged block reported as truncated:", err)
+	}
+}
+
+func TestInspect(t *testing.T) {
+	info, err := Inspect(bytes.NewReader(patchfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Magic != "BSDIFF40" || info.Format != "checksummed" || info.NewSize != int64(len(newfilecomp)) {
+		t.Fatalf("unexpected header %+v", info)
+	}
+	if !bytes.Equal(info.OldSum, sha256Sum(oldfile)) || info.NewSum != nil {
+		t.Fatalf("unexpected checksums %+v", info)
+	}
+	if info.Ctrl.Offset != checksummedHeaderLen || info.Ctrl.CompressedSize != 41 ||
+		info.Diff.CompressedSize != 42 || info.Extra.Offset+info.Extra.CompressedSize != int64(len(patchfile)) {
+		t.Fatalf("unexpected blocks %+v %+v %+v", info.Ctrl, info.Diff, info.Extra)
+	}
+	if info.Ctrl.Size != 24*info.Entries || info.Entries == 0 {
+		t.Fatalf("unexpected control block %+v with %v entries", info.Ctrl, info.Entries)
+	}
+	if info.DiffBytes+info.ExtraBytes != info.NewSize || info.Diff.Size != info.DiffBytes ||
+		info.Extra.Size != info.ExtraBytes || info.Unchanged > info.DiffBytes {
+		t.Fatalf("unexpected statistics %+v", info)
+	}
+
+	if _, err := Inspect(bytes.NewReader(patchfile[:len(patchfile)-1])); !errors.Is(err, ErrTruncated) {
+		t.Fatal("expected ErrTruncated, got", err)
+	}
+
+	// Bytes the control triples don't use are rejected, as they are when
+	// applying the patch
+	triples := []ctrlTriple{{2, 2, 0}}
+	for name, patch := range map[string][]byte{
+		"ctrl":  classicPatch(t, append(triples, ctrlTriple{}), []byte{0, 1}, []byte{2, 3}),
+		"diff":  classicPatch(t, triples, []byte{0, 1, 4}, []byte{2, 3}),
+		"extra": classicPatch(t, triples, []byte{0, 1}, []byte{2, 3, 4}),
+	} {
+		_, err := Inspect(bytes.NewReader(patch))
+		var berr BlockError
+		var cerr CorruptPatchError
+		if !errors.As(err, &berr) || berr.Block != name || !errors.As(err, &cerr) {
+			t.Errorf("%s: expected corrupt %s block, got %v", name, name, err)
+		}
+		if _, err := Bytes([]byte("ab"), patch); err == nil {
+			t.Errorf("%s: patch with unused bytes was applied", name)
+		}
+	}
+}
+
+// classicPatch builds a classic patch from control triples and the
+// uncompressed diff and extra blocks. newsize is the sum of the triples'
+// lengths.
+func classicPatch(t testing.TB, triples []ctrlTriple, diff, extra []byte) []byte {
+	bz, err := codec.Get(codec.Bzip2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compress := func(b []byte) []byte {
+		buf := new(bytes.Buffer)
+		w, err := bz.NewWriter(buf, codec.BestSpeed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(b); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	putInt := func(buf []byte, x int64) {
+		y := x
+		if x < 0 {
+			y = -x
+		}
+		binary.LittleEndian.PutUint64(buf, uint64(y))
+		if x < 0 {
+			buf[7] |= 0x80
+		}
+	}
+
+	var newsize int64
+	ctrl := make([]byte, 24*len(triples))
+	for i, trip := range triples {
+		for j := range trip {
+			putInt(ctrl[24*i+8*j:], trip[j])
+		}
+		newsize += trip.sum() + trip.copy()
+	}
+	ctrlbz, diffbz := compress(ctrl), compress(diff)
+	header := make([]byte, classicHeaderLen)
+	copy(header, "BSDIFF40")
+	putInt(header[8:], int64(len(ctrlbz)))
+	putInt(header[16:], int64(len(diffbz)))
+	putInt(header[24:], newsize)
+	patch := append(header, ctrlbz...)
+	patch = append(patch, diffbz...)
+	return append(patch, compress(extra)...)
+}
+
+func TestValidate(t *testing.T) {
+	if err := Validate(bytes.NewReader(oldfile), bytes.NewReader(patchfile)); err != nil {
+		t.Fatal(err)
+	}
+	wrongold := append([]byte{}, oldfile...)
+	wrongold[0] ^= 0xFF
+	if err := Validate(bytes.NewReader(wrongold), bytes.NewReader(patchfile)); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatal("expected ErrChecksumMismatch, got", err)
+	}
+
+	old := []byte("0123456789")
+	tests := []struct {
+		name    string
+		triples []ctrlTriple
+		diff    []byte
+		extra   []byte
+		valid   bool
+		// triple is the index of the triple at fault, or -1
+		triple int64
+	}{
+		{"valid", []ctrlTriple{{4, 2, 2}, {4, 0, 0}}, make([]byte, 8), []byte("ab"), true, -1},
+		{"read past old", []ctrlTriple{{4, 0, 4}, {4, 0, 0}}, make([]byte, 8), nil, false, 1},
+		{"seek before old", []ctrlTriple{{4, 0, -5}, {1, 0, 0}}, make([]byte, 5), nil, false, 0},
+		{"seek after old", []ctrlTriple{{4, 0, 7}, {0, 1, 0}}, make([]byte, 4), []byte("a"), false, 0},
+		{"negative diff", []ctrlTriple{{2, 0, 0}, {-1, 3, 0}, {0, 0, 0}}, make([]byte, 2), []byte("abc"), false, 1},
+		{"negative extra", []ctrlTriple{{3, -1, 0}, {0, 1, 0}}, make([]byte, 3), nil, false, 0},
+		{"diff too long", []ctrlTriple{{4, 0, 0}}, make([]byte, 5), nil, false, -1},
+		{"extra too long", []ctrlTriple{{4, 1, 0}}, make([]byte, 4), []byte("ab"), false, -1},
+		{"diff too short", []ctrlTriple{{4, 0, 0}}, make([]byte, 3), nil, false, -1},
+	}
+	for _, test := range tests {
+		patch := classicPatch(t, test.triples, test.diff, test.extra)
+		err := Validate(bytes.NewReader(old), bytes.NewReader(patch))
+		if test.valid {
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			}
+			continue
+		}
+		var cerr CorruptPatchError
+		if !errors.As(err, &cerr) {
+			t.Errorf("%s: expected CorruptPatchError, got %v", test.name, err)
+		} else if cerr.Triple != test.triple {
+			t.Errorf("%s: expected triple %v, got %v", test.name, test.triple, err)
+		}
+		// a real apply must fail the same way
+		if _, err2 := Bytes(old, patch); err2 == nil || err2.Error() != err.Error() {
+			t.Errorf("%s: Bytes returned %v, Validate %v", test.name, err2, err)
+		}
+	}
+}
+
+func TestEmptyTriples(t *testing.T) {
+	// triples that produce no output can't make patching spin
+	triples := make([]ctrlTriple, 100)
+	triples = append(triples, ctrlTriple{2, 0, 0})
+	patch := classicPatch(t, triples, make([]byte, 2), nil)
+	_, err := Bytes([]byte("ab"), patch)
+	var cerr CorruptPatchError
+	if !errors.As(err, &cerr) || cerr.Triple != 3 {
+		t.Fatal("expected CorruptPatchError for triple 3, got", err)
+	}
+}
+
+func TestReadAhead(t *testing.T) {
+	for _, n := range []int{0, 1, 7, defaultReadAheadSize} {
+		newf := new(bytes.Buffer)
+		if err := New(WithReadAhead(n)).Apply(bytes.NewReader(oldfile), newf, bytes.NewReader(patchfile)); err != nil {
+			t.Fatal(n, err)
+		}
+		if !bytes.Equal(newf.Bytes(), newfilecomp) {
+			t.Fatal(n, "new files are different")
+		}
+	}
+
+	// errors are returned after the data read before them
+	data := bytes.Repeat([]byte("read ahead "), 1000)
+	errRead := errors.New("read failed")
+	r := newReadAhead(ioutil.NopCloser(io.MultiReader(bytes.NewReader(data), iotest.ErrReader(errRead))), 64)
+	out, err := ioutil.ReadAll(r)
+	if err != errRead || !bytes.Equal(out, data) {
+		t.Fatal("expected the data and errRead, got", len(out), err)
+	}
+	if _, err := r.Read(make([]byte, 1)); err != errRead {
+		t.Fatal("expected errRead again, got", err)
+	}
+	r.Close()
+
+	// closing early stops the goroutine
+	r = newReadAhead(ioutil.NopCloser(bytes.NewReader(data)), 64)
+	if _, err := io.ReadFull(r, make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,82 @@
+package bspatch
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// ChainError is returned by ApplyChain when one of its patches fails.
+type ChainError struct {
+	// Step is the index of the failing patch in the chain.
+	Step int
+	// Steps is the number of patches in the chain.
+	Steps int
+	Err   error
+}
+
+func (e ChainError) Error() string {
+	return fmt.Sprintf("patch %v of %v: %v", e.Step+1, e.Steps, e.Err)
+}
+
+func (e ChainError) Unwrap() error {
+	return e.Err
+}
+
+// ApplyChain applies patches one after the other, starting from old, and
+// writes the result to out, with the default options. See
+// Patcher.ApplyChain.
+func ApplyChain(old io.ReadSeeker, out io.Writer, patches ...io.ReaderAt) error {
+	return New().ApplyChain(old, out, patches...)
+}
+
+// ApplyChain applies patches one after the other, the first to old and
+// each of the others to the result of the one before, and writes the result
+// of the last to out. Each intermediate file is streamed into a temporary
+// file, removed once the next patch has been applied, so at most two exist
+// at a time. Every step checks the checksum of its old file, if its patch
+// records one, before anything is written.
+//
+// If a step fails, ApplyChain returns a ChainError holding its index and
+// error; out may have been partially written if it was the last. With no
+// patches, old is copied to out. WithProgress reports each step separately.
+func (p *Patcher) ApplyChain(old io.ReadSeeker, out io.Writer, patches ...io.ReaderAt) error {
+	if len(patches) == 0 {
+		_, err := io.Copy(out, old)
+		return err
+	}
+	var prev *os.File
+	defer func() {
+		if prev != nil {
+			prev.Close()
+			os.Remove(prev.Name())
+		}
+	}()
+	for i, patch := range patches {
+		if i == len(patches)-1 {
+			if err := p.Apply(old, out, patch); err != nil {
+				return ChainError{i, len(patches), err}
+			}
+			break
+		}
+		tmp, err := ioutil.TempFile(p.cfg.tempDir, "bspatch-chain")
+		if err != nil {
+			return ChainError{i, len(patches), err}
+		}
+		err = p.Apply(old, tmp, patch)
+		if err == nil {
+			_, err = tmp.Seek(0, io.SeekStart)
+		}
+		if prev != nil {
+			prev.Close()
+			os.Remove(prev.Name())
+		}
+		prev = tmp
+		if err != nil {
+			return ChainError{i, len(patches), err}
+		}
+		old = tmp
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package bspatch
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/kiteco/go-bsdiff/v2/pkg/bsdiff"
+	"github.com/kiteco/go-bsdiff/v2/pkg/codec"
+)
+
+func TestApplyChain(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	versions := [][]byte{make([]byte, 20000)}
+	rnd.Read(versions[0])
+	for i := 0; i < 3; i++ {
+		versions = append(versions, mutate(rnd, versions[i]))
+	}
+	var patches []io.ReaderAt
+	for i, opts := range [][]bsdiff.Option{
+		nil,
+		{bsdiff.WithFormat(bsdiff.FormatExtended), bsdiff.WithCodec(codec.Zstd)},
+		{bsdiff.WithFormat(bsdiff.FormatClassic)},
+	} {
+		patch, err := bsdiff.Bytes(versions[i], versions[i+1], opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		patches = append(patches, bytes.NewReader(patch))
+	}
+	tmp, err := ioutil.TempDir("", "chain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	p := New(WithTempDir(tmp))
+	checkTemp := func() {
+		if files, _ := ioutil.ReadDir(tmp); len(files) != 0 {
+			t.Errorf("%v temporary files left behind", len(files))
+		}
+	}
+
+	for n := 0; n <= len(patches); n++ {
+		var out bytes.Buffer
+		if err := p.ApplyChain(bytes.NewReader(versions[0]), &out, patches[:n]...); err != nil {
+			t.Fatal(n, err)
+		}
+		if !bytes.Equal(out.Bytes(), versions[n]) {
+			t.Errorf("chain of %v patches does not reproduce version %v", n, n)
+		}
+		checkTemp()
+	}
+
+	// A patch out of order fails the checksum of its old file
+	var chainErr ChainError
+	err = p.ApplyChain(bytes.NewReader(versions[0]), ioutil.Discard, patches[0], patches[0], patches[1])
+	if !errors.As(err, &chainErr) || chainErr.Step != 1 || !errors.Is(err, ErrChecksumMismatch) {
+		t.Error("patch out of order: unexpected error", err)
+	}
+	checkTemp()
+	last, _ := ioutil.ReadAll(io.NewSectionReader(patches[2], 0, math.MaxInt32))
+	err = ApplyChain(bytes.NewReader(versions[0]), ioutil.Discard, patches[0], patches[1], bytes.NewReader(last[:len(last)-1]))
+	if !errors.As(err, &chainErr) || chainErr.Step != 2 || !errors.Is(err, ErrTruncated) {
+		t.Error("truncated last patch: unexpected error", err)
+	}
+	if err == nil || !strings.HasPrefix(err.Error(), "patch 3 of 3: ") {
+		t.Error("error does not name the step:", err)
+	}
+}
@@ -0,0 +1,331 @@
+package bspatch
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"sort"
+
+	"github.com/kiteco/go-bsdiff/v2/pkg/codec"
+)
+
+// decodedPatch is a patch with its blocks decompressed.
+type decodedPatch struct {
+	h           *header
+	triples     []ctrlTriple
+	diff, extra []byte
+}
+
+// decodePatch decompresses the blocks of patch and checks that the control
+// triples use them exactly. The old file is unknown, so the triples are
+// only checked against the new file.
+func decodePatch(patch []byte) (*decodedPatch, error) {
+	h, err := readHeader(bytes.NewReader(patch))
+	if err != nil {
+		return nil, err
+	}
+	xtraoff := h.dataOff + h.ctrlLen + h.diffLen
+	offs := [3]int64{h.dataOff, h.dataOff + h.ctrlLen, xtraoff}
+	lens := [3]int64{h.ctrlLen, h.diffLen, math.MaxInt64 - xtraoff}
+	var data [3][]byte
+	for i, name := range []string{"ctrl", "diff", "extra"} {
+		c, err := codec.Get(h.codecs[i])
+		if err != nil {
+			return nil, newCorruptPatchError(err.Error())
+		}
+		br := newBlockReader(name, bytes.NewReader(patch), offs[i], lens[i])
+		r, err := c.NewReader(br)
+		if err != nil {
+			return nil, br.wrap(err)
+		}
+		data[i], err = ioutil.ReadAll(r)
+		if cerr := r.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return nil, br.wrap(err)
+		}
+	}
+
+	d := &decodedPatch{h: h, diff: data[1], extra: data[2]}
+	ctrl := data[0]
+	var newpos, diffpos, extrapos int64
+	for newpos < h.newSize {
+		if len(ctrl) < 24 {
+			return nil, newCorruptPatchBzEndError(int64(len(ctrl)%8), 8, "control data", io.EOF)
+		}
+		t := ctrlTriple{offtin(ctrl), offtin(ctrl[8:]), offtin(ctrl[16:])}
+		ctrl = ctrl[24:]
+		if err := t.check(int64(len(d.triples)), newpos, h.newSize, 0, -1); err != nil {
+			return nil, err
+		}
+		if t.sum() > int64(len(d.diff))-diffpos {
+			return nil, newCorruptPatchBzEndError(int64(len(d.diff))-diffpos, t.sum(), "x data block", io.EOF)
+		}
+		if t.copy() > int64(len(d.extra))-extrapos {
+			return nil, newCorruptPatchBzEndError(int64(len(d.extra))-extrapos, t.copy(), "y extra block", io.EOF)
+		}
+		d.triples = append(d.triples, t)
+		newpos += t.sum() + t.copy()
+		diffpos += t.sum()
+		extrapos += t.copy()
+	}
+	for _, b := range []struct {
+		name   string
+		unused int64
+	}{{"ctrl", int64(len(ctrl))}, {"diff", int64(len(d.diff)) - diffpos}, {"extra", int64(len(d.extra)) - extrapos}} {
+		if b.unused != 0 {
+			return nil, newCorruptPatchError(fmt.Sprintf("%v unused bytes at the end of the %s block", b.unused, b.name))
+		}
+	}
+	return d, nil
+}
+
+// span is a run of the intermediate file of two composed patches, as made
+// by the first patch: either old file bytes plus diff bytes, or extra bytes.
+type span struct {
+	// start is where the run starts in the intermediate file.
+	start int64
+	// oldpos is where the old file bytes start, or -1 for extra bytes.
+	oldpos int64
+	// data is the run's diff or extra bytes.
+	data []byte
+}
+
+// spans returns the runs of d's new file, in order.
+func (d *decodedPatch) spans() []span {
+	var spans []span
+	var newpos, oldpos int64
+	diff, extra := d.diff, d.extra
+	for _, t := range d.triples {
+		if t.sum() > 0 {
+			spans = append(spans, span{newpos, oldpos, diff[:t.sum()]})
+			diff = diff[t.sum():]
+		}
+		newpos += t.sum()
+		if t.copy() > 0 {
+			spans = append(spans, span{newpos, -1, extra[:t.copy()]})
+			extra = extra[t.copy():]
+		}
+		newpos += t.copy()
+		oldpos += t.sum() + t.seek()
+	}
+	return spans
+}
+
+// composer builds the control triples and blocks of a composed patch from
+// runs of old file bytes plus diff bytes and runs of extra bytes.
+type composer struct {
+	ctrl, diff, extra bytes.Buffer
+	// The pending triple, whose seek isn't known yet, adds the old file
+	// from oldpos to the diff bytes from diffStart and then copies the
+	// extra bytes from extraStart.
+	oldpos                int64
+	diffStart, extraStart int
+}
+
+// add appends a run of old file bytes from oldpos plus the diff bytes
+// a + b, which must be as long.
+func (c *composer) add(oldpos int64, a, b []byte) {
+	end := c.oldpos + int64(c.diff.Len()-c.diffStart)
+	if c.extra.Len() > c.extraStart || end != oldpos {
+		c.flush(oldpos - end)
+	}
+	for i := range a {
+		c.diff.WriteByte(a[i] + b[i])
+	}
+}
+
+// copy appends a run of the extra bytes a + b, which must be as long, or
+// just a if b is nil.
+func (c *composer) copy(a, b []byte) {
+	if b == nil {
+		c.extra.Write(a)
+		return
+	}
+	for i := range a {
+		c.extra.WriteByte(a[i] + b[i])
+	}
+}
+
+// flush writes the pending triple with the given seek. Only the first
+// triple can be empty, to seek to where the second starts.
+func (c *composer) flush(seek int64) {
+	var buf [24]byte
+	diffLen := int64(c.diff.Len() - c.diffStart)
+	offtout(diffLen, buf[:])
+	offtout(int64(c.extra.Len()-c.extraStart), buf[8:])
+	offtout(seek, buf[16:])
+	c.ctrl.Write(buf[:])
+	c.oldpos += diffLen + seek
+	c.diffStart, c.extraStart = c.diff.Len(), c.extra.Len()
+}
+
+// Compose merges a patch from A to B and one from B to C into a patch from A
+// to C. See Patcher.Compose.
+func Compose(p1, p2 []byte, opts ...Option) ([]byte, error) {
+	return New(opts...).Compose(p1, p2)
+}
+
+// Compose merges p1, a patch from file A to file B, and p2, a patch from B
+// to C, into a single patch from A to C, without B. Bytes of C that p2 takes
+// from B, where p1 took them from A, are taken from A directly with the sum
+// of both patches' diff bytes. Those that p1 took from its extra block go to
+// the extra block of the composed patch.
+//
+// An extended p1 records the checksum of B, and an extended or checksummed
+// p2 that of its old file. When both are recorded with the same algorithm,
+// Compose checks that p2 was made for B and otherwise fails with a
+// ChecksumError for the old file, which matches ErrChecksumMismatch.
+// Otherwise Compose can't tell, and a mismatched p2 gives a composed patch
+// that makes the wrong file. Applying a composed patch checks the checksum
+// of A, and that of C if it is recorded.
+//
+// The composed patch has p1's format, codecs and checksum of A. An extended
+// patch also records the checksum of C, so an extended p1 can only be
+// composed with an extended p2 that uses the same checksum algorithm.
+// Patches made with bsdiff.WithELFFilter can only be composed with patches
+// that use the same filter. Both patches are decoded in memory; with
+// WithMemoryLimit, Compose fails with ErrMemoryLimit if B and C together
+// are larger than the limit.
+func (p *Patcher) Compose(p1, p2 []byte) ([]byte, error) {
+	if p.cfg.memLimit > 0 {
+		var size int64
+		for _, patch := range [][]byte{p1, p2} {
+			h, err := readHeader(bytes.NewReader(patch))
+			if err != nil {
+				return nil, err
+			}
+			size += h.newSize
+		}
+		if size > p.cfg.memLimit {
+			return nil, ErrMemoryLimit
+		}
+	}
+	d1, err := decodePatch(p1)
+	if err != nil {
+		return nil, fmt.Errorf("first patch: %w", err)
+	}
+	d2, err := decodePatch(p2)
+	if err != nil {
+		return nil, fmt.Errorf("second patch: %w", err)
+	}
+	if d1.h.filter != d2.h.filter {
+		return nil, fmt.Errorf("patches with filters %v and %v can't be composed", d1.h.filter, d2.h.filter)
+	}
+	if d1.h.format == formatExtended && (d2.h.format != formatExtended || d2.h.sumAlg != d1.h.sumAlg) {
+		return nil, errors.New("an extended patch can only be composed with an extended patch with the same checksum algorithm")
+	}
+	if d1.h.newSum != nil && d2.h.oldSum != nil && d1.h.sumAlg == d2.h.sumAlg && !bytes.Equal(d1.h.newSum, d2.h.oldSum) {
+		return nil, fmt.Errorf("second patch: %w", newChecksumError("oldfile", d1.h.newSum, d2.h.oldSum))
+	}
+
+	spans := d1.spans()
+	bsize := d1.h.newSize
+	var c composer
+	var bpos int64
+	diff, extra := d2.diff, d2.extra
+	for i, t := range d2.triples {
+		if t.sum() > bsize-bpos || t.sum() > 0 && bpos < 0 {
+			return nil, newCorruptTripleError(int64(i), "second patch reads past the end of the first patch's new file")
+		}
+		// Take the bytes p2 adds to B from wherever p1 took them
+		for n := t.sum(); n > 0; {
+			j := sort.Search(len(spans), func(j int) bool { return spans[j].start > bpos }) - 1
+			s := spans[j]
+			off := bpos - s.start
+			k := int64(len(s.data)) - off
+			if k > n {
+				k = n
+			}
+			a, b := s.data[off:off+k], diff[:k]
+			if s.oldpos < 0 {
+				c.copy(a, b)
+			} else {
+				c.add(s.oldpos+off, a, b)
+			}
+			diff = diff[k:]
+			bpos += k
+			n -= k
+		}
+		if t.copy() > 0 {
+			c.copy(extra[:t.copy()], nil)
+			extra = extra[t.copy():]
+		}
+		bpos += t.seek()
+	}
+	if c.diff.Len() > c.diffStart || c.extra.Len() > c.extraStart {
+		c.flush(0)
+	}
+	return writeComposed(d1.h, d2.h, &c)
+}
+
+// writeComposed writes the header and compressed blocks of the patch built
+// by c, which applies to the old file of h1 and makes the new file of h2.
+func writeComposed(h1, h2 *header, c *composer) ([]byte, error) {
+	sumLen := h1.sumAlg.Size()
+	magic, headerLen := "BSDIFF40", checksummedHeaderLen
+	switch h1.format {
+	case formatClassic:
+		headerLen = classicHeaderLen
+	case formatExtended:
+		magic, headerLen = "BSDIFFX1", 40+2*sumLen
+	}
+	header := make([]byte, headerLen)
+	copy(header, magic)
+	offtout(h2.newSize, header[24:])
+	switch h1.format {
+	case formatChecksummed:
+		copy(header[32:], h1.oldSum)
+	case formatExtended:
+		copy(header[32:35], []byte{byte(h1.codecs[0]), byte(h1.codecs[1]), byte(h1.codecs[2])})
+		header[35] = byte(h1.sumAlg)
+		header[36] = byte(h1.filter)
+		copy(header[40:], h1.oldSum)
+		copy(header[40+sumLen:], h2.newSum)
+	}
+
+	var blocks [3]bytes.Buffer
+	for i, data := range []*bytes.Buffer{&c.ctrl, &c.diff, &c.extra} {
+		comp, err := codec.Get(h1.codecs[i])
+		if err != nil {
+			return nil, err
+		}
+		w, err := comp.NewWriter(&blocks[i], codec.DefaultLevel)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := data.WriteTo(w); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	}
+	offtout(int64(blocks[0].Len()), header[8:])
+	offtout(int64(blocks[1].Len()), header[16:])
+	out := bytes.NewBuffer(make([]byte, 0, headerLen+blocks[0].Len()+blocks[1].Len()+blocks[2].Len()))
+	out.Write(header)
+	for i := range blocks {
+		blocks[i].WriteTo(out)
+	}
+	return out.Bytes(), nil
+}
+
+// offtout puts an int64 (little endian) to buf
+func offtout(x int64, buf []byte) {
+	y := x
+	if x < 0 {
+		y = -x
+	}
+	for i := 0; i < 8; i++ {
+		buf[i] = byte(y)
+		y >>= 8
+	}
+	if x < 0 {
+		buf[7] |= 0x80
+	}
+}
@@ -0,0 +1,154 @@
+package bspatch
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/kiteco/go-bsdiff/v2/pkg/bsdiff"
+	"github.com/kiteco/go-bsdiff/v2/pkg/checksum"
+	"github.com/kiteco/go-bsdiff/v2/pkg/codec"
+)
+
+// mutate returns a copy of b with random bytes changed, inserted and
+// removed, and a few blocks moved.
+func mutate(rnd *rand.Rand, b []byte) []byte {
+	out := append([]byte(nil), b...)
+	for i := 0; i < 20; i++ {
+		pos := rnd.Intn(len(out))
+		switch rnd.Intn(4) {
+		case 0:
+			out[pos] ^= byte(1 + rnd.Intn(255))
+		case 1:
+			ins := make([]byte, rnd.Intn(200))
+			rnd.Read(ins)
+			out = append(out[:pos], append(ins, out[pos:]...)...)
+		case 2:
+			out = append(out[:pos], out[min(len(out), pos+rnd.Intn(200)):]...)
+		case 3:
+			from := rnd.Intn(len(out))
+			blk := append([]byte(nil), out[from:min(len(out), from+500)]...)
+			out = append(out[:pos], append(blk, out[pos:]...)...)
+		}
+	}
+	return out
+}
+
+func TestCompose(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	a := make([]byte, 20000)
+	for i := range a {
+		// Text-like bytes, so that bsdiff finds approximate matches
+		a[i] = byte('a' + rnd.Intn(4))
+	}
+	b := mutate(rnd, a)
+	c := mutate(rnd, b)
+	for _, test := range []struct {
+		name string
+		opts []bsdiff.Option
+	}{
+		{"checksummed", nil},
+		{"classic", []bsdiff.Option{bsdiff.WithFormat(bsdiff.FormatClassic)}},
+		{"extended", []bsdiff.Option{bsdiff.WithFormat(bsdiff.FormatExtended), bsdiff.WithCodec(codec.Zstd), bsdiff.WithChecksum(checksum.SHA512)}},
+	} {
+		p1, err := bsdiff.Bytes(a, b, test.opts...)
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+		p2, err := bsdiff.Bytes(b, c, test.opts...)
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+		composed, err := Compose(p1, p2)
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+		if !bytes.Equal(composed[:8], p1[:8]) {
+			t.Errorf("%s: composed patch has magic %q", test.name, composed[:8])
+		}
+		// Applying the composed patch gives what applying both does
+		b2, err := Bytes(a, p1)
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+		c2, err := Bytes(b2, p2)
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+		c3, err := Bytes(a, composed)
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+		if !bytes.Equal(c2, c) || !bytes.Equal(c3, c2) {
+			t.Fatalf("%s: composed patch does not reproduce the result of both patches", test.name)
+		}
+		if _, err := Bytes(b, composed); err == nil && test.name != "classic" {
+			t.Errorf("%s: composed patch applied to the intermediate file", test.name)
+		}
+	}
+
+	// Composing with a patch that leaves the file unchanged
+	same, err := bsdiff.Bytes(b, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p1, _ := bsdiff.Bytes(a, b)
+	composed, err := Compose(p1, same)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b2, err := Bytes(a, composed); err != nil || !bytes.Equal(b2, b) {
+		t.Fatal("composing with an identity patch changed the result:", err)
+	}
+
+	if _, err := Compose(p1, p1[:len(p1)-1]); !errors.Is(err, ErrTruncated) {
+		t.Error("truncated second patch: unexpected error", err)
+	}
+	filtered, err := bsdiff.Bytes(b, c, bsdiff.WithFormat(bsdiff.FormatExtended), bsdiff.WithELFFilter(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Compose(p1, filtered); err != nil {
+		t.Error("filter is none for files that aren't executables:", err)
+	}
+	// An extended patch records the checksum of C, which only another
+	// extended patch has
+	extended, err := bsdiff.Bytes(a, b, bsdiff.WithFormat(bsdiff.FormatExtended))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Compose(extended, same); err == nil {
+		t.Error("composed an extended patch with a checksummed one")
+	}
+	// Both record the checksum of B, which must match
+	wrong, err := bsdiff.Bytes(c, a, bsdiff.WithFormat(bsdiff.FormatExtended))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cerr ChecksumError
+	if _, err := Compose(extended, wrong); !errors.As(err, &cerr) || cerr.Name != "oldfile" || !errors.Is(err, ErrChecksumMismatch) {
+		t.Error("second patch for another file: unexpected error", err)
+	}
+}
+
+func TestComposeCorrupt(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		p1, p2 []byte
+		err    error
+	}{
+		{"bad magic", oldfile, patchfile, ErrBadMagic},
+		{"truncated first patch", patchfile[:len(patchfile)-1], patchfile, ErrTruncated},
+		{"truncated second patch", patchfile, patchfile[:40], ErrTruncated},
+		{"empty second patch", patchfile, nil, ErrTruncated},
+	} {
+		_, err := Compose(test.p1, test.p2)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+	}
+	if _, err := Compose(patchfile, patchfile, WithMemoryLimit(20)); err != ErrMemoryLimit {
+		t.Error("expected ErrMemoryLimit, got", err)
+	}
+}
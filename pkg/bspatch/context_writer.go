@@ -0,0 +1,23 @@
+package bspatch
+
+import "context"
+
+// contextWriter fails once ctx is done and reports progress after every
+// write, so long copies within a single control triple can be cancelled.
+type contextWriter struct {
+	ctx      context.Context
+	w        *writeCounter
+	total    int64
+	progress ProgressFunc
+}
+
+func (cw *contextWriter) Write(p []byte) (int, error) {
+	if err := cw.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := cw.w.Write(p)
+	if cw.progress != nil {
+		cw.progress(cw.w.Count(), cw.total)
+	}
+	return n, err
+}
@@ -1,22 +1,94 @@
 package bspatch
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrChecksumMismatch is matched by errors.Is when the old or new file
+	// doesn't have the checksum recorded in the patch. Use errors.As with a
+	// ChecksumError to get the digests.
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	// ErrBadMagic is matched by errors.Is when the input is not a patch.
+	ErrBadMagic = errors.New("incorrect magic number")
+	// ErrTruncated is matched by errors.Is when the patch ends before its
+	// header or blocks do, as with an interrupted download.
+	ErrTruncated = errors.New("patch is truncated")
+)
 
 type CorruptPatchError struct {
 	Name string
+	// Triple is the index of the control triple at fault, or -1.
+	Triple int64
+	// Err is the underlying cause, if any.
+	Err error
 }
 
 func newCorruptPatchError(e string) CorruptPatchError {
-	return CorruptPatchError{"corrupt patch: " + e}
+	return CorruptPatchError{Name: "corrupt patch: " + e, Triple: -1}
+}
+
+func wrapCorruptPatchError(e string, err error) CorruptPatchError {
+	return CorruptPatchError{"corrupt patch: " + e, -1, err}
+}
+
+func newCorruptTripleError(i int64, e string) CorruptPatchError {
+	return CorruptPatchError{fmt.Sprintf("corrupt patch: control triple %v: %s", i, e), i, nil}
 }
 
 // Functionally, consumers should handle a corrupt patch and a bz end error the same.
 func newCorruptPatchBzEndError(read int64, expected int64, label string, prevErr error) CorruptPatchError {
 	errmsg := fmt.Sprintf("corrupt patch or bz stream ended: %s read (%v/%v), ", label, read, expected)
 	errmsg += fmt.Sprintf("upstream error: %v", prevErr)
-	return CorruptPatchError{errmsg}
+	return CorruptPatchError{errmsg, -1, prevErr}
 }
 
 func (e CorruptPatchError) Error() string {
 	return e.Name
 }
+
+func (e CorruptPatchError) Unwrap() error {
+	return e.Err
+}
+
+// ChecksumError is returned when a file's checksum doesn't match the one
+// recorded in the patch. It matches ErrChecksumMismatch.
+type ChecksumError struct {
+	// Name is the file that was checked, "oldfile" or "newfile".
+	Name     string
+	Expected []byte
+	Actual   []byte
+}
+
+func newChecksumError(name string, expected, actual []byte) ChecksumError {
+	return ChecksumError{name, expected, actual}
+}
+
+func (e ChecksumError) Error() string {
+	return fmt.Sprintf("invalid %s checksum: expected % x, but got % x", e.Name, e.Expected, e.Actual)
+}
+
+func (e ChecksumError) Unwrap() error {
+	return ErrChecksumMismatch
+}
+
+// BlockError is returned when one of the patch's compressed blocks can't be
+// read. Err is usually a CorruptPatchError and matches ErrTruncated if the
+// patch ended inside the block.
+type BlockError struct {
+	// Block is "ctrl", "diff" or "extra".
+	Block string
+	// Offset is how far into the patch the block had been read when the
+	// error occurred.
+	Offset int64
+	Err    error
+}
+
+func (e BlockError) Error() string {
+	return fmt.Sprintf("%s block at offset %v: %v", e.Block, e.Offset, e.Err)
+}
+
+func (e BlockError) Unwrap() error {
+	return e.Err
+}
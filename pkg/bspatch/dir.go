@@ -0,0 +1,378 @@
+package bspatch
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Tree patch entry operations and kinds, as written by bsdiff.Dir.
+const (
+	dirAdded     = 1
+	dirRemoved   = 2
+	dirRenamed   = 3
+	dirModified  = 4
+	dirUnchanged = 5
+
+	kindFile    = 0
+	kindDir     = 1
+	kindSymlink = 2
+)
+
+// maxTreeString bounds the paths and symlink targets of a tree patch.
+const maxTreeString = 4096
+
+// treeEntry is one entry of a tree patch's manifest.
+type treeEntry struct {
+	op, kind             byte
+	mode                 uint32
+	path, source, target string
+	size                 int64
+	sum                  [sha256.Size]byte
+}
+
+// treeReader reads a tree patch sequentially from off, counting the bytes
+// it has consumed.
+type treeReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func newTreeReader(patch io.ReaderAt, off int64) *treeReader {
+	return &treeReader{r: bufio.NewReader(io.NewSectionReader(patch, off, math.MaxInt64-off))}
+}
+
+func (tr *treeReader) ReadByte() (byte, error) {
+	b, err := tr.r.ReadByte()
+	if err == nil {
+		tr.n++
+	}
+	return b, err
+}
+
+func (tr *treeReader) read(p []byte) error {
+	n, err := io.ReadFull(tr.r, p)
+	tr.n += int64(n)
+	return err
+}
+
+func (tr *treeReader) uvarint() (uint64, error) {
+	return binary.ReadUvarint(tr)
+}
+
+func (tr *treeReader) string() (string, error) {
+	n, err := tr.uvarint()
+	if err != nil {
+		return "", err
+	}
+	if n > maxTreeString {
+		return "", newCorruptPatchError(fmt.Sprintf("tree string of %v bytes", n))
+	}
+	buf := make([]byte, n)
+	if err := tr.read(buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// treeError turns the errors of reading a tree patch into corrupt patch
+// errors.
+func treeError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return wrapCorruptPatchError("tree patch ended early", ErrTruncated)
+	}
+	var cerr CorruptPatchError
+	if errors.As(err, &cerr) {
+		return err
+	}
+	return wrapCorruptPatchError("tree patch: "+err.Error(), err)
+}
+
+// validTreePath reports whether p is a clean relative path within a tree.
+func validTreePath(p string) bool {
+	return p != "" && p != "." && path.Clean(p) == p && !path.IsAbs(p) &&
+		p != ".." && !strings.HasPrefix(p, "../")
+}
+
+// readTreeManifest reads the manifest of a tree patch and returns it with
+// the offset of the patch's data.
+func readTreeManifest(patch io.ReaderAt) ([]treeEntry, int64, error) {
+	tr := newTreeReader(patch, 0)
+	magic := make([]byte, 8)
+	err := tr.read(magic)
+	if !bytes.HasPrefix([]byte("BSDIFFD1"), magic[:tr.n]) {
+		return nil, 0, wrapCorruptPatchError("incorrect magic number (tree header BSDIFFD1)", ErrBadMagic)
+	}
+	if err != nil {
+		return nil, 0, treeError(err)
+	}
+	count, err := tr.uvarint()
+	if err != nil {
+		return nil, 0, treeError(err)
+	}
+	var entries []treeEntry
+	for i := uint64(0); i < count; i++ {
+		var e treeEntry
+		var opkind [2]byte
+		var mode, size uint64
+		if err = tr.read(opkind[:]); err == nil {
+			e.op, e.kind = opkind[0], opkind[1]
+			mode, err = tr.uvarint()
+		}
+		if err == nil {
+			e.path, err = tr.string()
+		}
+		if err == nil {
+			e.source, err = tr.string()
+		}
+		if err == nil {
+			e.target, err = tr.string()
+		}
+		if err == nil {
+			size, err = tr.uvarint()
+		}
+		if err == nil {
+			err = tr.read(e.sum[:])
+		}
+		if err != nil {
+			return nil, 0, treeError(err)
+		}
+		e.mode, e.size = uint32(mode), int64(size)
+		if err := e.check(mode, size); err != nil {
+			return nil, 0, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, tr.n, nil
+}
+
+// check validates an entry read from a tree patch.
+func (e *treeEntry) check(mode, size uint64) error {
+	switch {
+	case e.op < dirAdded || e.op > dirUnchanged:
+		return newCorruptPatchError(fmt.Sprintf("tree entry %q has unknown operation %v", e.path, e.op))
+	case e.kind > kindSymlink:
+		return newCorruptPatchError(fmt.Sprintf("tree entry %q has unknown kind %v", e.path, e.kind))
+	case mode > 07777 || size > math.MaxInt64:
+		return newCorruptPatchError(fmt.Sprintf("tree entry %q has invalid mode or size", e.path))
+	case !validTreePath(e.path):
+		return newCorruptPatchError(fmt.Sprintf("invalid tree path %q", e.path))
+	case e.kind == kindFile && (e.op == dirRenamed || e.op == dirModified || e.op == dirUnchanged) && !validTreePath(e.source):
+		return newCorruptPatchError(fmt.Sprintf("invalid tree path %q", e.source))
+	}
+	return nil
+}
+
+// fileMode converts the Unix mode bits of a tree patch to an os.FileMode.
+func fileMode(mode uint32) os.FileMode {
+	m := os.FileMode(mode) & os.ModePerm
+	if mode&04000 != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+// Dir applies a tree patch made by bsdiff.Dir to the tree below oldDir and
+// writes the new tree to outDir. See Patcher.Dir.
+func Dir(oldDir, outDir string, patch io.ReaderAt, opts ...Option) error {
+	return New(opts...).Dir(oldDir, outDir, patch)
+}
+
+// Dir applies a tree patch made by bsdiff.Dir to the tree below oldDir and
+// writes the new tree to outDir, which must not exist yet. Files that are
+// unchanged or were renamed are hard-linked from oldDir when their
+// permissions allow it and copied otherwise. Every file taken from oldDir
+// is checked against the SHA-256 recorded in the patch, as is every file
+// written. If patching fails, outDir is removed.
+func (p *Patcher) Dir(oldDir, outDir string, patch io.ReaderAt) error {
+	entries, off, err := readTreeManifest(patch)
+	if err != nil {
+		return fmt.Errorf("bspatch: %w", err)
+	}
+	if err := os.Mkdir(outDir, 0755); err != nil {
+		return fmt.Errorf("bspatch: %w", err)
+	}
+	if err := p.applyTree(oldDir, outDir, entries, patch, off); err != nil {
+		os.RemoveAll(outDir)
+		return fmt.Errorf("bspatch: %w", err)
+	}
+	return nil
+}
+
+func (p *Patcher) applyTree(oldDir, outDir string, entries []treeEntry, patch io.ReaderAt, off int64) error {
+	// Directories are created writable and get their permissions once
+	// they have been filled
+	dirs := map[string]bool{".": true}
+	var created []treeEntry
+	for _, e := range entries {
+		if e.op == dirRemoved {
+			continue
+		}
+		// Only write below directories of the tree itself, never
+		// through a symlink
+		if !dirs[path.Dir(e.path)] {
+			return newCorruptPatchError(fmt.Sprintf("parent of tree entry %q is not a directory", e.path))
+		}
+		dst := filepath.Join(outDir, filepath.FromSlash(e.path))
+		var err error
+		switch {
+		case e.kind == kindDir:
+			if err = os.Mkdir(dst, 0700); err == nil {
+				dirs[e.path] = true
+				created = append(created, e)
+			}
+		case e.kind == kindSymlink:
+			err = os.Symlink(e.target, dst)
+		case e.op == dirAdded || e.op == dirModified:
+			off, err = p.treeFile(oldDir, dst, e, patch, off)
+		default:
+			err = linkTreeFile(oldDir, dst, e)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", e.path, err)
+		}
+	}
+	for i := len(created) - 1; i >= 0; i-- {
+		e := created[i]
+		if err := os.Chmod(filepath.Join(outDir, filepath.FromSlash(e.path)), fileMode(e.mode)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// treeFile applies the patch at off in the tree patch to create an added
+// or modified file, and returns the offset of the next patch.
+func (p *Patcher) treeFile(oldDir, dst string, e treeEntry, patch io.ReaderAt, off int64) (int64, error) {
+	tr := newTreeReader(patch, off)
+	n, err := tr.uvarint()
+	if err != nil {
+		return 0, treeError(err)
+	}
+	off += tr.n
+	if n > uint64(math.MaxInt64-off) {
+		return 0, newCorruptPatchError(fmt.Sprintf("file patch of %v bytes", n))
+	}
+
+	var oldf io.ReadSeeker = bytes.NewReader(nil)
+	if e.op == dirModified {
+		src, _, err := oldTreeFile(oldDir, e.source)
+		if err != nil {
+			return 0, err
+		}
+		f, err := os.Open(src)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		oldf = f
+	}
+	newf, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return 0, err
+	}
+	h := sha256.New()
+	err = p.Apply(oldf, io.MultiWriter(newf, h), io.NewSectionReader(patch, off, int64(n)))
+	if cerr := newf.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, err
+	}
+	if sum := h.Sum(nil); !bytes.Equal(sum, e.sum[:]) {
+		return 0, newChecksumError("newfile", e.sum[:], sum)
+	}
+	return off + int64(n), os.Chmod(dst, fileMode(e.mode))
+}
+
+// linkTreeFile hard-links or copies an unchanged or renamed file from the
+// old tree.
+func linkTreeFile(oldDir, dst string, e treeEntry) error {
+	src, fi, err := oldTreeFile(oldDir, e.source)
+	if err != nil {
+		return err
+	}
+	sum, err := hashFile(src)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(sum, e.sum[:]) {
+		return fmt.Errorf("%s: %w", e.source, newChecksumError("oldfile", e.sum[:], sum))
+	}
+	if fi.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky) == fileMode(e.mode) {
+		if err := os.Link(src, dst); err == nil {
+			return nil
+		}
+	}
+
+	srcf, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcf.Close()
+	dstf, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dstf, srcf)
+	if cerr := dstf.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Chmod(dst, fileMode(e.mode))
+}
+
+// oldTreeFile returns the path and FileInfo of the regular file rel in the
+// old tree. Every parent of it below oldDir must be a directory rather than
+// a symlink, so that a patch can't read or link files outside oldDir.
+func oldTreeFile(oldDir, rel string) (string, os.FileInfo, error) {
+	name := oldDir
+	parts := strings.Split(rel, "/")
+	for i, part := range parts {
+		name = filepath.Join(name, part)
+		fi, err := os.Lstat(name)
+		if err != nil {
+			return "", nil, err
+		}
+		if i == len(parts)-1 {
+			if !fi.Mode().IsRegular() {
+				return "", nil, fmt.Errorf("%s is not a regular file", rel)
+			}
+			return name, fi, nil
+		}
+		if !fi.IsDir() {
+			return "", nil, fmt.Errorf("%s: %s is not a directory in the old tree", rel, path.Join(parts[:i+1]...))
+		}
+	}
+	return "", nil, fmt.Errorf("%q is not a file path", rel)
+}
+
+func hashFile(name string) ([]byte, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
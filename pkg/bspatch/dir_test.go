@@ -0,0 +1,149 @@
+package bspatch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kiteco/go-bsdiff/v2/pkg/bsdiff"
+)
+
+// writeTree creates files below dir from a map of slash-separated paths to
+// contents.
+func writeTree(t *testing.T, dir string, files map[string]string) {
+	for p, content := range files {
+		name := filepath.Join(dir, filepath.FromSlash(p))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bspatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	olddir := filepath.Join(dir, "old")
+	newdir := filepath.Join(dir, "new")
+	outdir := filepath.Join(dir, "out")
+	writeTree(t, olddir, map[string]string{"sub/secret": "secret", "sub/other": "other", "unchanged.txt": "unchanged"})
+	writeTree(t, newdir, map[string]string{"sub/secret": "secret", "sub/other": "changed other", "unchanged.txt": "unchanged"})
+	patch := new(bytes.Buffer)
+	if err := bsdiff.Dir(olddir, newdir, patch); err != nil {
+		t.Fatal(err)
+	}
+	if err := Dir(olddir, outdir, bytes.NewReader(patch.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(outdir, "sub", "other")); err != nil || string(b) != "changed other" {
+		t.Fatal("patched tree does not hold the new file:", string(b), err)
+	}
+
+	// The output directory must not exist
+	if err := Dir(olddir, outdir, bytes.NewReader(patch.Bytes())); !os.IsExist(errors.Unwrap(err)) {
+		t.Fatal("expected an existing outdir to fail, got", err)
+	}
+	// A changed old tree fails and leaves no output behind
+	os.RemoveAll(outdir)
+	if err := ioutil.WriteFile(filepath.Join(olddir, "unchanged.txt"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Dir(olddir, outdir, bytes.NewReader(patch.Bytes())); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatal("expected ErrChecksumMismatch, got", err)
+	}
+	if _, err := os.Stat(outdir); !os.IsNotExist(err) {
+		t.Fatal("partial outdir was not removed")
+	}
+	// So does a truncated patch
+	if err := Dir(olddir, outdir, bytes.NewReader(patch.Bytes()[:patch.Len()-1])); !errors.Is(err, ErrTruncated) {
+		t.Fatal("expected ErrTruncated, got", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(olddir, "unchanged.txt"), []byte("unchanged"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Old files are never reached through symlinked directories, which
+	// could lead outside the old tree
+	outside := filepath.Join(dir, "outside")
+	if err := os.Rename(filepath.Join(olddir, "sub"), outside); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(olddir, "sub")); err != nil {
+		t.Fatal(err)
+	}
+	if err := Dir(olddir, outdir, bytes.NewReader(patch.Bytes())); err == nil || !strings.Contains(err.Error(), "not a directory") {
+		t.Fatal("expected a symlinked parent to be rejected, got", err)
+	}
+}
+
+// treePatch encodes a tree patch manifest without any file patches.
+func treePatch(entries []treeEntry) []byte {
+	buf := []byte("BSDIFFD1")
+	buf = binary.AppendUvarint(buf, uint64(len(entries)))
+	for _, e := range entries {
+		buf = append(buf, e.op, e.kind)
+		buf = binary.AppendUvarint(buf, uint64(e.mode))
+		for _, s := range []string{e.path, e.source, e.target} {
+			buf = binary.AppendUvarint(buf, uint64(len(s)))
+			buf = append(buf, s...)
+		}
+		buf = binary.AppendUvarint(buf, uint64(e.size))
+		buf = append(buf, e.sum[:]...)
+	}
+	return buf
+}
+
+func TestDirCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bspatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	outdir := filepath.Join(dir, "out")
+
+	for _, test := range []struct {
+		name    string
+		entries []treeEntry
+	}{
+		{"parent path", []treeEntry{{op: dirAdded, kind: kindDir, mode: 0755, path: "../escape"}}},
+		{"absolute path", []treeEntry{{op: dirAdded, kind: kindDir, mode: 0755, path: "/escape"}}},
+		{"unclean path", []treeEntry{{op: dirAdded, kind: kindDir, mode: 0755, path: "a/../../escape"}}},
+		{"source path", []treeEntry{{op: dirUnchanged, kind: kindFile, mode: 0644, path: "a", source: "../secret"}}},
+		{"through a symlink", []treeEntry{
+			{op: dirAdded, kind: kindSymlink, path: "link", target: dir},
+			{op: dirAdded, kind: kindDir, mode: 0755, path: "link/escape"},
+		}},
+		{"missing parent", []treeEntry{{op: dirAdded, kind: kindDir, mode: 0755, path: "a/b"}}},
+		{"unknown operation", []treeEntry{{op: 9, kind: kindDir, mode: 0755, path: "a"}}},
+		{"invalid mode", []treeEntry{{op: dirAdded, kind: kindDir, mode: 0100755, path: "a"}}},
+	} {
+		err := Dir(dir, outdir, bytes.NewReader(treePatch(test.entries)))
+		var cerr CorruptPatchError
+		if !errors.As(err, &cerr) {
+			t.Errorf("%s: expected CorruptPatchError, got %v", test.name, err)
+		}
+		if _, err := os.Lstat(outdir); !os.IsNotExist(err) {
+			t.Fatalf("%s: outdir was not removed", test.name)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "escape")); !os.IsNotExist(err) {
+		t.Fatal("patch wrote outside of outdir")
+	}
+
+	if err := Dir(dir, outdir, bytes.NewReader(patchfile)); !errors.Is(err, ErrBadMagic) {
+		t.Fatal("expected ErrBadMagic, got", err)
+	}
+	if err := Dir(dir, outdir, bytes.NewReader([]byte("BSDIFFD"))); !errors.Is(err, ErrTruncated) {
+		t.Fatal("expected ErrTruncated, got", err)
+	}
+}
@@ -0,0 +1,98 @@
+package bspatch
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// FuzzPatch applies arbitrary patches. Patching must never panic, and must
+// fail cleanly rather than allocate memory without limit or spin on a patch
+// that doesn't make progress.
+func FuzzPatch(f *testing.F) {
+	f.Add(oldfile, patchfile)
+	patches, err := filepath.Glob(filepath.Join("testdata", "classic", "*.patch"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, name := range patches {
+		old, err := ioutil.ReadFile(strings.TrimSuffix(name, ".patch") + ".old")
+		if err != nil {
+			f.Fatal(err)
+		}
+		patch, err := ioutil.ReadFile(name)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(old, patch)
+	}
+	f.Fuzz(func(t *testing.T, old, patch []byte) {
+		newfile, err := Bytes(old, patch, WithMemoryLimit(fuzzMemoryLimit))
+		if err != nil {
+			return
+		}
+		h, err := readHeader(bytes.NewReader(patch))
+		if err != nil {
+			t.Fatal("patch applied but its header is invalid:", err)
+		}
+		if int64(len(newfile)) != h.newSize {
+			t.Fatalf("new file is %v bytes, expected %v", len(newfile), h.newSize)
+		}
+		if err := Validate(bytes.NewReader(old), bytes.NewReader(patch)); err != nil {
+			t.Fatal("patch applied but doesn't validate:", err)
+		}
+	})
+}
+
+// fuzzMemoryLimit bounds the new files the fuzz targets create.
+const fuzzMemoryLimit = 64 << 20
+
+// FuzzControlTriples applies patches built from arbitrary control triples.
+// Whatever the triples, patching must either fail with a CorruptPatchError
+// or produce a new file of the expected size.
+func FuzzControlTriples(f *testing.F) {
+	f.Add([]byte("0123456789"), []byte{4, 2, 2, 4, 0, 0})
+	f.Add([]byte("0123456789"), []byte{4, 0, 0x85, 1, 0, 0})
+	f.Add([]byte("abc"), []byte{0x81, 4, 0})
+	f.Fuzz(func(t *testing.T, old []byte, ctrl []byte) {
+		// Each triple is three bytes of ctrl, sign-extended
+		var triples []ctrlTriple
+		var diffLen, extraLen int64
+		for len(ctrl) >= 3 && len(triples) < 64 {
+			var trip ctrlTriple
+			for i := range trip {
+				trip[i] = int64(int8(ctrl[i]))
+			}
+			triples = append(triples, trip)
+			if trip.sum() > 0 {
+				diffLen += trip.sum()
+			}
+			if trip.copy() > 0 {
+				extraLen += trip.copy()
+			}
+			ctrl = ctrl[3:]
+		}
+		diff := make([]byte, diffLen)
+		extra := bytes.Repeat([]byte{'x'}, int(extraLen))
+		patch := classicPatch(t, triples, diff, extra)
+
+		newfile, err := Bytes(old, patch)
+		if err != nil {
+			var cerr CorruptPatchError
+			if !errors.As(err, &cerr) {
+				t.Fatalf("expected CorruptPatchError, got %v", err)
+			}
+			return
+		}
+		h, err := readHeader(bytes.NewReader(patch))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(newfile)) != h.newSize {
+			t.Fatalf("new file is %v bytes, expected %v", len(newfile), h.newSize)
+		}
+	})
+}
@@ -0,0 +1,162 @@
+package bspatch
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/kiteco/go-bsdiff/v2/pkg/checksum"
+	"github.com/kiteco/go-bsdiff/v2/pkg/codec"
+	"github.com/kiteco/go-bsdiff/v2/pkg/filter"
+)
+
+const (
+	// formatChecksummed is this package's BSDIFF40 layout with the SHA-256
+	// of the old file at bytes 32-63.
+	formatChecksummed = iota
+	// formatClassic is the upstream BSDIFF40 layout with a 32-byte header.
+	formatClassic
+	// formatExtended is the BSDIFFX1 layout, which records the codec of
+	// each block at bytes 32-34, the checksum algorithm at 35, the filter
+	// at 36 and the checksums of the old and new files from 40.
+	formatExtended
+)
+
+const (
+	classicHeaderLen     = 32
+	checksummedHeaderLen = 64
+	// maxHeaderLen is the length of a BSDIFFX1 header with the longest
+	// checksums.
+	maxHeaderLen = 40 + 2*sha512.Size
+)
+
+// Every bzip2 stream starts with "BZh", the block size, and either a block
+// header or the end of stream marker.
+var (
+	bzip2BlockMagic = []byte{0x31, 0x41, 0x59, 0x26, 0x53, 0x59}
+	bzip2EOSMagic   = []byte{0x17, 0x72, 0x45, 0x38, 0x50, 0x90}
+)
+
+// header is the parsed header of a patch.
+type header struct {
+	format int
+	// codecs holds the codec of the control, diff and extra blocks.
+	codecs  [3]codec.ID
+	ctrlLen int64
+	diffLen int64
+	newSize int64
+	// sumAlg is the algorithm of oldSum and newSum.
+	sumAlg checksum.Algorithm
+	// oldSum is the expected checksum of the old file, or nil if the format
+	// doesn't carry one.
+	oldSum []byte
+	// newSum is the expected checksum of the new file, or nil if the format
+	// doesn't carry one.
+	newSum []byte
+	// filter is the filter applied to the old and new files before they
+	// were diffed.
+	filter filter.ID
+	// dataOff is the offset of the control block.
+	dataOff int64
+}
+
+// readHeader reads and validates the patch header. Both BSDIFF40 layouts
+// share the same magic, so they are told apart by whether a bzip2 stream or
+// a checksum follows the first 32 bytes.
+func readHeader(patch io.ReaderAt) (*header, error) {
+	buf := make([]byte, maxHeaderLen)
+	n, err := patch.ReadAt(buf, 0)
+	if err != nil && (err != io.EOF || n == 0) {
+		if err == io.EOF {
+			err = ErrTruncated
+		}
+		return nil, wrapCorruptPatchError(err.Error(), err)
+	}
+	buf = buf[:n]
+	if !hasMagic(buf) {
+		return nil, wrapCorruptPatchError("incorrect magic number (header BSDIFF40)", ErrBadMagic)
+	}
+	if n < classicHeaderLen {
+		errmsg := fmt.Sprintf("short header read (n %v < %v)", n, classicHeaderLen)
+		return nil, wrapCorruptPatchError(errmsg, ErrTruncated)
+	}
+
+	h := &header{
+		codecs:  [3]codec.ID{codec.Bzip2, codec.Bzip2, codec.Bzip2},
+		sumAlg:  checksum.SHA256,
+		ctrlLen: offtin(buf[8:]),
+		diffLen: offtin(buf[16:]),
+		newSize: offtin(buf[24:]),
+	}
+
+	// Check for appropriate magic
+	switch {
+	case bytes.Equal(buf[:8], []byte("BSDIFFX1")):
+		if n < 40 {
+			errmsg := fmt.Sprintf("short header read (n %v < %v)", n, 40)
+			return nil, wrapCorruptPatchError(errmsg, ErrTruncated)
+		}
+		h.format = formatExtended
+		h.codecs = [3]codec.ID{codec.ID(buf[32]), codec.ID(buf[33]), codec.ID(buf[34])}
+		h.sumAlg = checksum.Algorithm(buf[35])
+		if h.filter = filter.ID(buf[36]); !h.filter.Valid() {
+			return nil, newCorruptPatchError(fmt.Sprintf("unknown filter %v", buf[36]))
+		}
+		sumLen := int64(h.sumAlg.Size())
+		if sumLen == 0 {
+			return nil, newCorruptPatchError(fmt.Sprintf("unknown checksum algorithm %v", buf[35]))
+		}
+		h.dataOff = 40 + 2*sumLen
+		if int64(n) < h.dataOff {
+			errmsg := fmt.Sprintf("short header read (n %v < %v)", n, h.dataOff)
+			return nil, wrapCorruptPatchError(errmsg, ErrTruncated)
+		}
+		h.oldSum = buf[40 : 40+sumLen]
+		h.newSum = buf[40+sumLen : 40+2*sumLen]
+	case !bytes.Equal(buf[:8], []byte("BSDIFF40")):
+		return nil, wrapCorruptPatchError("incorrect magic number (header BSDIFF40)", ErrBadMagic)
+	case isBzip2Stream(buf[classicHeaderLen:]):
+		h.format = formatClassic
+		h.dataOff = classicHeaderLen
+	default:
+		if n < checksummedHeaderLen {
+			errmsg := fmt.Sprintf("short header read (n %v < %v)", n, checksummedHeaderLen)
+			return nil, wrapCorruptPatchError(errmsg, ErrTruncated)
+		}
+		h.format = formatChecksummed
+		h.dataOff = checksummedHeaderLen
+		h.oldSum = buf[32:64]
+	}
+
+	if h.ctrlLen < 0 || h.diffLen < 0 || h.newSize < 0 {
+		errmsg := fmt.Sprintf("negative length block(s) read from header (bzctrllen %v bzdatalen %v newsize %v)", h.ctrlLen, h.diffLen, h.newSize)
+		return nil, newCorruptPatchError(errmsg)
+	}
+	if h.ctrlLen > math.MaxInt64-h.dataOff-h.diffLen {
+		errmsg := fmt.Sprintf("block lengths overflow (bzctrllen %v bzdatalen %v)", h.ctrlLen, h.diffLen)
+		return nil, newCorruptPatchError(errmsg)
+	}
+	return h, nil
+}
+
+// hasMagic reports whether buf starts with one of the patch magics. A buf
+// shorter than a magic only has to match its start, so that a truncated
+// patch isn't mistaken for something else.
+func hasMagic(buf []byte) bool {
+	for _, magic := range []string{"BSDIFF40", "BSDIFFX1"} {
+		n := min(len(buf), len(magic))
+		if bytes.Equal(buf[:n], []byte(magic[:n])) {
+			return true
+		}
+	}
+	return false
+}
+
+func isBzip2Stream(b []byte) bool {
+	if len(b) < 10 || !bytes.Equal(b[:3], []byte("BZh")) || b[3] < '1' || b[3] > '9' {
+		return false
+	}
+	return bytes.Equal(b[4:10], bzip2BlockMagic) || bytes.Equal(b[4:10], bzip2EOSMagic)
+}
@@ -0,0 +1,185 @@
+package bspatch
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+
+	"github.com/kiteco/go-bsdiff/v2/pkg/checksum"
+	"github.com/kiteco/go-bsdiff/v2/pkg/codec"
+	"github.com/kiteco/go-bsdiff/v2/pkg/filter"
+)
+
+// Info describes a patch, as returned by Inspect.
+type Info struct {
+	// Magic is the first 8 bytes of the patch, "BSDIFF40" or "BSDIFFX1".
+	Magic string
+	// Format is "classic", "checksummed" or "extended".
+	Format string
+	// NewSize is the size of the new file.
+	NewSize int64
+	// Checksum is the algorithm of OldSum and NewSum.
+	Checksum checksum.Algorithm
+	// OldSum is the checksum of the old file, or nil if the format doesn't
+	// carry one.
+	OldSum []byte
+	// NewSum is the checksum of the new file, or nil if the format doesn't
+	// carry one.
+	NewSum []byte
+	// Filter is the filter applied to both files before diffing them.
+	Filter filter.ID
+	// Ctrl, Diff and Extra describe the three blocks.
+	Ctrl, Diff, Extra BlockInfo
+	// Entries is the number of control triples.
+	Entries int64
+	// DiffBytes is the number of bytes of the new file made by adding the
+	// diff block to the old file, and Unchanged how many of those were
+	// copied from the old file as they were.
+	DiffBytes int64
+	Unchanged int64
+	// ExtraBytes is the number of bytes of the new file taken from the
+	// extra block.
+	ExtraBytes int64
+}
+
+// BlockInfo describes one of the blocks of a patch.
+type BlockInfo struct {
+	Codec codec.ID
+	// Offset is where the block starts in the patch.
+	Offset int64
+	// CompressedSize and Size are the sizes of the block in the patch and
+	// after decompressing it.
+	CompressedSize int64
+	Size           int64
+}
+
+// Inspect reads a patch without applying it. The control triples are
+// decoded and the diff and extra blocks are decompressed to gather the
+// statistics in Info, so a patch that can be inspected is well formed,
+// though it may still not match a given old file.
+func Inspect(patch io.ReaderAt) (*Info, error) {
+	h, err := readHeader(patch)
+	if err != nil {
+		return nil, err
+	}
+	magic := make([]byte, 8)
+	if _, err := patch.ReadAt(magic, 0); err != nil {
+		return nil, err
+	}
+
+	info := &Info{
+		Magic:    string(magic),
+		Format:   []string{"checksummed", "classic", "extended"}[h.format],
+		NewSize:  h.newSize,
+		Checksum: h.sumAlg,
+		OldSum:   h.oldSum,
+		NewSum:   h.newSum,
+		Filter:   h.filter,
+	}
+	xtraoff := h.dataOff + h.ctrlLen + h.diffLen
+	info.Ctrl = BlockInfo{Codec: h.codecs[0], Offset: h.dataOff, CompressedSize: h.ctrlLen}
+	info.Diff = BlockInfo{Codec: h.codecs[1], Offset: h.dataOff + h.ctrlLen, CompressedSize: h.diffLen}
+	info.Extra = BlockInfo{Codec: h.codecs[2], Offset: xtraoff}
+	info.Extra.CompressedSize, err = io.Copy(ioutil.Discard, io.NewSectionReader(patch, xtraoff, math.MaxInt64-xtraoff))
+	if err != nil {
+		return nil, err
+	}
+
+	var decomp [3]codec.Codec
+	for i, id := range h.codecs {
+		if decomp[i], err = codec.Get(id); err != nil {
+			return nil, newCorruptPatchError(err.Error())
+		}
+	}
+	ctrlbz := newBlockReader("ctrl", patch, info.Ctrl.Offset, info.Ctrl.CompressedSize)
+	ctrl, err := decomp[0].NewReader(ctrlbz)
+	if err != nil {
+		return nil, ctrlbz.wrap(err)
+	}
+	defer ctrl.Close()
+	databz := newBlockReader("diff", patch, info.Diff.Offset, info.Diff.CompressedSize)
+	data, err := decomp[1].NewReader(databz)
+	if err != nil {
+		return nil, databz.wrap(err)
+	}
+	defer data.Close()
+	xtrabz := newBlockReader("extra", patch, xtraoff, math.MaxInt64-xtraoff)
+	xtra, err := decomp[2].NewReader(xtrabz)
+	if err != nil {
+		return nil, xtrabz.wrap(err)
+	}
+	defer xtra.Close()
+
+	// Decode the control triples the way patchStream does, but count the
+	// diff and extra bytes instead of applying them
+	ctrlr := bufio.NewReader(ctrl)
+	buf := make([]byte, 8)
+	var ctrip ctrlTriple
+	var newpos int64
+	for newpos < h.newSize {
+		for i := 0; i < 3; i++ {
+			lenread, err := io.ReadFull(ctrlr, buf)
+			if lenread != 8 || (err != nil && err != io.EOF) {
+				return nil, ctrlbz.wrap(newCorruptPatchBzEndError(int64(lenread), 8, "control data", err))
+			}
+			ctrip[i] = offtin(buf)
+		}
+		// The old file is unknown, so only the new file bounds are checked
+		if err := ctrip.check(info.Entries, newpos, h.newSize, 0, -1); err != nil {
+			return nil, err
+		}
+		info.Entries++
+		newpos += ctrip.sum() + ctrip.copy()
+		info.DiffBytes += ctrip.sum()
+		info.ExtraBytes += ctrip.copy()
+	}
+
+	// The diff and extra blocks are only decompressed to be measured; bytes
+	// of the diff block that are zero leave the old file unchanged
+	var zeros int64
+	diffw := writerFunc(func(p []byte) (int, error) {
+		for _, b := range p {
+			if b == 0 {
+				zeros++
+			}
+		}
+		return len(p), nil
+	})
+	// As in patchStream, the control triples must use all of the blocks
+	for _, b := range []struct {
+		r    io.Reader
+		w    io.Writer
+		br   *blockReader
+		size *int64
+		used int64
+	}{
+		{ctrlr, ioutil.Discard, ctrlbz, &info.Ctrl.Size, 0},
+		{data, diffw, databz, &info.Diff.Size, info.DiffBytes},
+		{xtra, ioutil.Discard, xtrabz, &info.Extra.Size, info.ExtraBytes},
+	} {
+		n, err := io.Copy(b.w, b.r)
+		if err != nil {
+			return nil, b.br.wrap(err)
+		}
+		if n > b.used {
+			errmsg := fmt.Sprintf("%v unused bytes at the end of the %s block", n-b.used, b.br.name)
+			return nil, b.br.wrap(newCorruptPatchError(errmsg))
+		}
+		*b.size = n
+	}
+	info.Ctrl.Size += 24 * info.Entries
+	if info.Diff.Size < info.DiffBytes {
+		return nil, databz.wrap(newCorruptPatchBzEndError(info.Diff.Size, info.DiffBytes, "x data block", io.EOF))
+	}
+	if info.Extra.Size < info.ExtraBytes {
+		return nil, xtrabz.wrap(newCorruptPatchBzEndError(info.Extra.Size, info.ExtraBytes, "y extra block", io.EOF))
+	}
+	info.Unchanged = zeros
+	return info, nil
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
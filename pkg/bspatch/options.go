@@ -0,0 +1,152 @@
+package bspatch
+
+import "errors"
+
+// ErrMemoryLimit is returned by Bytes when the new file would be larger than
+// the limit set with WithMemoryLimit.
+var ErrMemoryLimit = errors.New("bspatch: new file exceeds memory limit")
+
+// Default buffer sizes for streaming
+const (
+	defaultWriteBufferSize = 1024 * 1024
+	defaultCopyBufferSize  = 1024 * 1024
+	defaultReadAheadSize   = 1024 * 1024
+	// defaultCheckpointInterval is how much of the new file Resume writes
+	// between checkpoints
+	defaultCheckpointInterval = 4 * 1024 * 1024
+)
+
+// ProgressFunc is called periodically with the number of bytes of the new
+// file written so far and its total size.
+type ProgressFunc func(done, total int64)
+
+// Option configures how a patch is applied.
+type Option func(*config)
+
+type config struct {
+	writeBufSize int
+	copyBufSize  int
+	readAhead    int
+	memLimit     int64
+	progress     ProgressFunc
+	tempDir      string
+	checkpoint   int64
+}
+
+func newConfig(opts []Option) *config {
+	c := &config{
+		writeBufSize: defaultWriteBufferSize,
+		copyBufSize:  defaultCopyBufferSize,
+		readAhead:    defaultReadAheadSize,
+		checkpoint:   defaultCheckpointInterval,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// WithProgress sets a callback that reports how much of the new file has
+// been written. It is called from the patching goroutine.
+func WithProgress(f ProgressFunc) Option {
+	return func(c *config) {
+		c.progress = f
+	}
+}
+
+// WithWriteBufferSize sets the size of the buffer in front of the new file.
+// The default is 1 MiB.
+func WithWriteBufferSize(n int) Option {
+	return func(c *config) {
+		c.writeBufSize = n
+	}
+}
+
+// WithCopyBufferSize sets the size of the buffer used to copy data from
+// the patch blocks and the old file. The default is 1 MiB.
+func WithCopyBufferSize(n int) Option {
+	return func(c *config) {
+		c.copyBufSize = n
+	}
+}
+
+// WithReadAhead sets how many bytes of the diff and extra blocks are
+// decompressed ahead of use, each block on its own goroutine. Zero
+// decompresses them on the patching goroutine. The default is 1 MiB.
+func WithReadAhead(n int) Option {
+	return func(c *config) {
+		c.readAhead = n
+	}
+}
+
+// WithMemoryLimit caps the memory used for the write and copy buffers at
+// about n bytes, shrinking them if needed, and turns read-ahead off if it
+// does not fit as well. Decompressor state is not included. Bytes, which
+// holds the new file in memory, fails with ErrMemoryLimit if the new file
+// is larger than n, and so does applying a patch made with
+// bsdiff.WithELFFilter if two copies of the old file are. Zero means no
+// limit.
+func WithMemoryLimit(n int64) Option {
+	return func(c *config) {
+		c.memLimit = n
+	}
+}
+
+func (c *config) writeBufferSize() int {
+	return c.limit(c.writeBufSize)
+}
+
+func (c *config) copyBufferSize() int {
+	return c.limit(c.copyBufSize)
+}
+
+func (c *config) readAheadSize() int {
+	if c.readAhead <= 0 {
+		return 0
+	}
+	if c.memLimit > 0 && int64(c.writeBufferSize())+int64(c.copyBufferSize())+2*int64(c.readAhead) > c.memLimit {
+		return 0
+	}
+	return c.readAhead
+}
+
+func (c *config) checkpointInterval() int64 {
+	if c.checkpoint < 1 {
+		return 1
+	}
+	return c.checkpoint
+}
+
+// limit shrinks a buffer of size n to its share of the memory limit.
+func (c *config) limit(n int) int {
+	if n < 1 {
+		n = 1
+	}
+	if c.memLimit <= 0 || int64(c.writeBufSize)+int64(c.copyBufSize) <= c.memLimit {
+		return n
+	}
+	if share := int(c.memLimit / 2); share < n {
+		n = share
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// WithTempDir sets the directory for the temporary files that hold the
+// intermediate files of ApplyChain. The default is os.TempDir.
+func WithTempDir(dir string) Option {
+	return func(c *config) {
+		c.tempDir = dir
+	}
+}
+
+// WithCheckpointInterval sets how many bytes of the new file Resume writes
+// between checkpoints. Each checkpoint syncs the new file to disk. The
+// default is 4 MiB.
+func WithCheckpointInterval(n int64) Option {
+	return func(c *config) {
+		c.checkpoint = n
+	}
+}
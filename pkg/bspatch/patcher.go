@@ -0,0 +1,107 @@
+package bspatch
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Patcher applies patches with a fixed set of options. A Patcher is safe
+// for concurrent use by multiple goroutines.
+type Patcher struct {
+	cfg *config
+}
+
+// New returns a Patcher configured by opts.
+func New(opts ...Option) *Patcher {
+	return &Patcher{newConfig(opts)}
+}
+
+// Bytes applies a patch with the oldfile to create the newfile
+func (p *Patcher) Bytes(oldfile, patch []byte) (newfile []byte, err error) {
+	return patchb(oldfile, patch, p.cfg)
+}
+
+// Reader applies a BSDIFF4 patch (using oldbin and patchf) to create the newbin.
+// If oldbin implements io.Seeker and patchf implements io.ReaderAt they are
+// streamed; otherwise they are read into memory first.
+func (p *Patcher) Reader(oldbin io.Reader, newbin io.Writer, patchf io.Reader) error {
+	oldrs, ok := oldbin.(io.ReadSeeker)
+	if !ok {
+		oldbs, err := ioutil.ReadAll(oldbin)
+		if err != nil {
+			return err
+		}
+		oldrs = bytes.NewReader(oldbs)
+	}
+	patchra, ok := patchf.(io.ReaderAt)
+	if !ok {
+		diffbytes, err := ioutil.ReadAll(patchf)
+		if err != nil {
+			return err
+		}
+		patchra = bytes.NewReader(diffbytes)
+	}
+	return p.Apply(oldrs, newbin, patchra)
+}
+
+// Apply applies a BSDIFF4 patch (using old and patch) to create new, streaming
+// all three. Memory use is bounded by the buffer sizes, not the file sizes.
+// The diff and extra blocks are read through concurrent ReadAt calls
+// unless read-ahead is turned off with WithReadAhead(0). Patches made with
+// bsdiff.WithELFFilter read the whole old file into memory.
+func (p *Patcher) Apply(old io.ReadSeeker, new io.Writer, patch io.ReaderAt) error {
+	return p.PatchContext(context.Background(), old, new, patch)
+}
+
+// PatchContext is like Apply but returns ctx.Err() if ctx is done before the
+// patch has been applied. new may have been partially written by then.
+func (p *Patcher) PatchContext(ctx context.Context, old io.ReadSeeker, new io.Writer, patch io.ReaderAt) error {
+	newfw := bufio.NewWriterSize(new, p.cfg.writeBufferSize())
+	if err := patchStream(ctx, old, newfw, patch, p.cfg, nil); err != nil {
+		return err
+	}
+	return newfw.Flush()
+}
+
+// Validate checks that patch applies cleanly to old without writing the new
+// file anywhere. It returns the same errors as Apply.
+func (p *Patcher) Validate(old io.ReadSeeker, patch io.ReaderAt) error {
+	return patchStream(context.Background(), old, ioutil.Discard, patch, p.cfg, nil)
+}
+
+// File applies a BSDIFF4 patch (using oldfile and patchfile) to create the newfile
+func (p *Patcher) File(oldfile, newfile, patchfile string) error {
+	oldf, err := os.Open(oldfile)
+	if err != nil {
+		return fmt.Errorf("could not open oldfile '%s': %w", oldfile, err)
+	}
+	defer oldf.Close()
+
+	newf, err := os.Create(newfile)
+	if err != nil {
+		return fmt.Errorf("could not open or create newfile '%s': %w", newfile, err)
+	}
+
+	patchf, err := os.Open(patchfile)
+	if err != nil {
+		newf.Close()
+		os.Remove(newfile)
+		return fmt.Errorf("could not read patchfile '%s': %w", patchfile, err)
+	}
+	defer patchf.Close()
+
+	err = p.Apply(oldf, newf, patchf)
+
+	if err != nil {
+		newf.Close()
+		os.Remove(newfile)
+		return fmt.Errorf("bspatch: %w", err)
+	}
+
+	return newf.Close()
+}
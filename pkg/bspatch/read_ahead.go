@@ -0,0 +1,103 @@
+package bspatch
+
+import "io"
+
+// readAheadBuffers is the number of buffers a readAhead fills ahead of its
+// reader.
+const readAheadBuffers = 4
+
+// readAhead decompresses a block on its own goroutine into a bounded pipe
+// of buffers, so the diff and extra blocks are decompressed concurrently
+// with each other and with the patching.
+type readAhead struct {
+	src  io.ReadCloser
+	full chan []byte
+	free chan []byte
+	// done is closed to stop the goroutine early.
+	done chan struct{}
+	// err is the error that ended the goroutine's reads. It is set before
+	// full is closed.
+	err    error
+	buf    []byte
+	cur    []byte
+	closed bool
+}
+
+// newReadAhead reads src up to size bytes ahead of the calls to Read.
+func newReadAhead(src io.ReadCloser, size int) *readAhead {
+	n := size / readAheadBuffers
+	if n < 1 {
+		n = 1
+	}
+	r := &readAhead{
+		src:  src,
+		full: make(chan []byte, readAheadBuffers),
+		free: make(chan []byte, readAheadBuffers),
+		done: make(chan struct{}),
+	}
+	for i := 0; i < readAheadBuffers; i++ {
+		r.free <- make([]byte, n)
+	}
+	go r.run()
+	return r
+}
+
+func (r *readAhead) run() {
+	defer close(r.full)
+	for {
+		var buf []byte
+		select {
+		case buf = <-r.free:
+		case <-r.done:
+			return
+		}
+		// Fill the buffer unless the stream ends first
+		var n int
+		var err error
+		for n < len(buf) && err == nil {
+			var m int
+			m, err = r.src.Read(buf[n:])
+			n += m
+		}
+		if n > 0 {
+			select {
+			case r.full <- buf[:n]:
+			case <-r.done:
+				return
+			}
+		}
+		if err != nil {
+			r.err = err
+			return
+		}
+	}
+}
+
+func (r *readAhead) Read(p []byte) (int, error) {
+	for len(r.cur) == 0 {
+		if r.buf != nil {
+			r.free <- r.buf[:cap(r.buf)]
+			r.buf = nil
+		}
+		buf, ok := <-r.full
+		if !ok {
+			return 0, r.err
+		}
+		r.buf, r.cur = buf, buf
+	}
+	n := copy(p, r.cur)
+	r.cur = r.cur[n:]
+	return n, nil
+}
+
+// Close stops the goroutine, waits for it and closes src.
+func (r *readAhead) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	close(r.done)
+	for range r.full {
+	}
+	return r.src.Close()
+}
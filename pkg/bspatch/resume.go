@@ -0,0 +1,241 @@
+package bspatch
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/kiteco/go-bsdiff/v2/pkg/filter"
+)
+
+// checkpoint is how far patchStream got through a patch.
+type checkpoint struct {
+	// triple is the index of the control triple being applied.
+	triple int64
+	// newpos, oldpos, diffpos and extrapos are where the triple starts in
+	// the new file, the old file and the decompressed diff and extra
+	// blocks.
+	newpos, oldpos, diffpos, extrapos int64
+	// done is how many bytes of the triple were written.
+	done int64
+}
+
+// checkpointer saves checkpoints for patchStream every interval bytes of
+// the new file.
+type checkpointer struct {
+	interval int64
+	// next is the size of the new file at which the next checkpoint is due.
+	next int64
+	// start is the checkpoint to pick up from, or nil.
+	start *checkpoint
+	// written holds the new file as written before start.
+	written io.ReaderAt
+	// save makes the new file durable up to the checkpoint and records it.
+	save func(checkpoint) error
+}
+
+const (
+	// Journal file format:
+	//  0 -  7 : "BSPATCHJ"
+	//  8 - 39 : sha256sum(patch)
+	// 40 - 87 : triple, newpos, oldpos, diffpos, extrapos and done of the
+	//           checkpoint, as little endian int64s
+	// 88 - 91 : CRC-32 (IEEE) of bytes 0-87
+	journalMagic = "BSPATCHJ"
+	journalLen   = 92
+)
+
+// errStaleCheckpoint is returned by patchStream for a checkpoint that
+// doesn't fit the patch it is resuming.
+var errStaleCheckpoint = errors.New("checkpoint is past the end of its control triple")
+
+// Resume applies patchfile to oldfile to create newfile, saving checkpoints
+// to journal. See Patcher.Resume.
+func Resume(oldfile, newfile, patchfile, journal string, opts ...Option) error {
+	return New(opts...).Resume(oldfile, newfile, patchfile, journal)
+}
+
+// Resume applies patchfile to oldfile to create newfile like File, but can
+// be interrupted, even by a crash or power loss, and called again to pick
+// up where it left off. Every WithCheckpointInterval bytes, it syncs
+// newfile to disk and records how far it got in journal. If journal holds a
+// checkpoint for the same patch, Resume continues from it rather than from
+// the start; the blocks of the patch are decompressed again up to the
+// checkpoint, but nothing before it is written again.
+//
+// On success newfile is synced and journal removed. On failure both are
+// left in place for the next call, unlike with File; remove them to start
+// over. If resuming from journal fails because it doesn't match newfile or
+// the patch, journal is discarded and Resume starts over by itself.
+// Patches made with bsdiff.WithELFFilter are applied from the start every
+// time, without checkpoints.
+func (p *Patcher) Resume(oldfile, newfile, patchfile, journal string) error {
+	oldf, err := os.Open(oldfile)
+	if err != nil {
+		return fmt.Errorf("could not open oldfile '%s': %w", oldfile, err)
+	}
+	defer oldf.Close()
+	patchf, err := os.Open(patchfile)
+	if err != nil {
+		return fmt.Errorf("could not read patchfile '%s': %w", patchfile, err)
+	}
+	defer patchf.Close()
+	h, err := readHeader(patchf)
+	if err != nil {
+		return fmt.Errorf("bspatch: %w", err)
+	}
+	id := sha256.New()
+	if _, err := io.Copy(id, io.NewSectionReader(patchf, 0, math.MaxInt64)); err != nil {
+		return fmt.Errorf("could not read patchfile '%s': %w", patchfile, err)
+	}
+	patchSum := id.Sum(nil)
+
+	newf, err := os.OpenFile(newfile, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return fmt.Errorf("could not open or create newfile '%s': %w", newfile, err)
+	}
+	defer newf.Close()
+	var start *checkpoint
+	if h.filter == filter.None {
+		start = readJournal(journal, patchSum)
+	}
+	if start != nil {
+		// newfile must still hold everything written before the checkpoint
+		if fi, err := newf.Stat(); err != nil || fi.Size() < start.newpos+start.done {
+			start = nil
+		}
+	}
+	err = p.resume(oldf, newf, patchf, h, journal, patchSum, start)
+	var cerr CorruptPatchError
+	if start != nil && (errors.Is(err, errStaleCheckpoint) || errors.Is(err, ErrChecksumMismatch) || errors.As(err, &cerr)) {
+		// The journal was stale or didn't match what newfile holds, so
+		// discard it and start over. A corrupt patch fails again.
+		if err := os.Remove(journal); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if _, err := oldf.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		err = p.resume(oldf, newf, patchf, h, journal, patchSum, nil)
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(journal); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return newf.Close()
+}
+
+// resume applies patchf to oldf from the checkpoint start, or from the
+// start if it is nil, and syncs newf.
+func (p *Patcher) resume(oldf, newf *os.File, patchf io.ReaderAt, h *header, journal string, patchSum []byte, start *checkpoint) error {
+	var written int64
+	if start != nil {
+		written = start.newpos + start.done
+	}
+	// Anything written after the checkpoint is written again
+	if err := newf.Truncate(written); err != nil {
+		return err
+	}
+	if _, err := newf.Seek(written, io.SeekStart); err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriterSize(newf, p.cfg.writeBufferSize())
+	var ck *checkpointer
+	if h.filter == filter.None {
+		ck = &checkpointer{
+			interval: p.cfg.checkpointInterval(),
+			start:    start,
+			written:  newf,
+			save: func(c checkpoint) error {
+				if err := bw.Flush(); err != nil {
+					return err
+				}
+				if err := newf.Sync(); err != nil {
+					return err
+				}
+				return writeJournal(journal, patchSum, c)
+			},
+		}
+	}
+	if err := patchStream(context.Background(), oldf, bw, patchf, p.cfg, ck); err != nil {
+		return fmt.Errorf("bspatch: %w", err)
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	return newf.Sync()
+}
+
+// readJournal returns the checkpoint in journal if it is one for the patch
+// with the SHA-256 patchSum, or nil.
+func readJournal(journal string, patchSum []byte) *checkpoint {
+	b, err := ioutil.ReadFile(journal)
+	if err != nil || len(b) != journalLen || string(b[:8]) != journalMagic || !bytes.Equal(b[8:40], patchSum) {
+		return nil
+	}
+	if crc32.ChecksumIEEE(b[:88]) != binary.LittleEndian.Uint32(b[88:]) {
+		return nil
+	}
+	var v [6]int64
+	for i := range v {
+		if v[i] = int64(binary.LittleEndian.Uint64(b[40+8*i:])); v[i] < 0 {
+			return nil
+		}
+	}
+	return &checkpoint{v[0], v[1], v[2], v[3], v[4], v[5]}
+}
+
+// writeJournal replaces journal with one recording c. The new journal is
+// written and synced beside it first, so a crash leaves either one whole,
+// and the directory is synced after the rename so that it is kept.
+func writeJournal(journal string, patchSum []byte, c checkpoint) error {
+	b := make([]byte, 0, journalLen)
+	b = append(b, journalMagic...)
+	b = append(b, patchSum...)
+	for _, v := range []int64{c.triple, c.newpos, c.oldpos, c.diffpos, c.extrapos, c.done} {
+		b = binary.LittleEndian.AppendUint64(b, uint64(v))
+	}
+	b = binary.LittleEndian.AppendUint32(b, crc32.ChecksumIEEE(b))
+
+	tmp := journal + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, journal); err != nil {
+		return err
+	}
+	d, err := os.Open(filepath.Dir(journal))
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
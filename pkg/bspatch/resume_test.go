@@ -0,0 +1,217 @@
+package bspatch
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kiteco/go-bsdiff/v2/pkg/bsdiff"
+	"github.com/kiteco/go-bsdiff/v2/pkg/codec"
+)
+
+// makeExecutable returns an x86-64 ELF file whose code calls or jumps to
+// functions in its first 4 KiB every few bytes. extra is inserted in the
+// middle of the code, moving the branches after it but not their targets.
+func makeExecutable(extra []byte) []byte {
+	const hdrLen = 64 + 56
+	b := make([]byte, hdrLen)
+	copy(b, "\x7fELF\x02\x01\x01")
+	binary.LittleEndian.PutUint16(b[16:], 2)
+	binary.LittleEndian.PutUint16(b[18:], 62)
+	binary.LittleEndian.PutUint64(b[32:], 64)
+	binary.LittleEndian.PutUint16(b[54:], 56)
+	binary.LittleEndian.PutUint16(b[56:], 1)
+	binary.LittleEndian.PutUint32(b[64:], 1)
+	binary.LittleEndian.PutUint32(b[68:], 5)
+	binary.LittleEndian.PutUint64(b[80:], 0x400000)
+	rnd := rand.New(rand.NewSource(1))
+	b = append(b, make([]byte, 4096)...)
+	rnd.Read(b[hdrLen:])
+	for len(b) < 1<<20 {
+		if len(b) >= 1<<19 && extra != nil {
+			b = append(b, extra...)
+			extra = nil
+		}
+		for i := rnd.Intn(8); i > 0; i-- {
+			b = append(b, byte(rnd.Intn(0xE8)))
+		}
+		target := hdrLen + rnd.Intn(64)*64
+		b = append(b, 0xE8+byte(rnd.Intn(2)))
+		b = binary.LittleEndian.AppendUint32(b, uint32(target-len(b)-4))
+	}
+	binary.LittleEndian.PutUint64(b[96:], uint64(len(b)))
+	return b
+}
+
+// crash is panicked with to stop Resume as a power loss would.
+type crash struct{}
+
+// resumeCrashing runs Resume until it has written at bytes of the
+// new file, and reports whether it got that far and the first progress it
+// reported.
+func resumeCrashing(oldfile, newfile, patchfile, journal string, at int64, opts ...Option) (crashed bool, first int64, err error) {
+	first = -1
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(crash); !ok {
+				panic(r)
+			}
+			crashed = true
+		}
+	}()
+	opts = append(opts, WithProgress(func(done, total int64) {
+		if first < 0 {
+			first = done
+		}
+		if done >= at {
+			panic(crash{})
+		}
+	}))
+	return false, first, Resume(oldfile, newfile, patchfile, journal, opts...)
+}
+
+func TestResume(t *testing.T) {
+	rnd := rand.New(rand.NewSource(4))
+	oldbs := make([]byte, 200000)
+	for i := range oldbs {
+		oldbs[i] = byte('a' + rnd.Intn(4))
+	}
+	newbs := mutate(rnd, mutate(rnd, oldbs))
+	dir, err := ioutil.TempDir("", "resume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldfile := filepath.Join(dir, "old")
+	newfile := filepath.Join(dir, "new")
+	patchfile := filepath.Join(dir, "patch")
+	journal := filepath.Join(dir, "journal")
+	if err := ioutil.WriteFile(oldfile, oldbs, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	const interval, copyBuf = 10000, 1000
+	opts := []Option{WithCheckpointInterval(interval), WithCopyBufferSize(copyBuf)}
+	for _, test := range []struct {
+		name string
+		opts []bsdiff.Option
+	}{
+		{"checksummed", nil},
+		{"classic", []bsdiff.Option{bsdiff.WithFormat(bsdiff.FormatClassic)}},
+		{"extended", []bsdiff.Option{bsdiff.WithFormat(bsdiff.FormatExtended), bsdiff.WithCodec(codec.Zstd)}},
+	} {
+		patch, err := bsdiff.Bytes(oldbs, newbs, test.opts...)
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+		if err := ioutil.WriteFile(patchfile, patch, 0644); err != nil {
+			t.Fatal(err)
+		}
+		// A journal of another patch is ignored
+		if err := ioutil.WriteFile(journal, bytes.Repeat([]byte{1}, 92), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		var crashes int
+		var last int64
+		for {
+			// Crash somewhere past the last crash
+			at := last + 1 + rnd.Int63n(3*interval)
+			crashed, first, err := resumeCrashing(oldfile, newfile, patchfile, journal, at, opts...)
+			if first >= 0 && first < last-interval-2*copyBuf {
+				t.Fatalf("%s: crashed at %v but resumed at %v", test.name, last, first)
+			}
+			if !crashed {
+				if err != nil {
+					t.Fatal(test.name, err)
+				}
+				break
+			}
+			if crashes++; crashes > 100 {
+				t.Fatal(test.name, "too many crashes")
+			}
+			last = at
+			// Bytes written after the last checkpoint may be lost or
+			// garbled, and so may the journal being written
+			f, err := os.OpenFile(newfile, os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Write(bytes.Repeat([]byte{0xFF}, rnd.Intn(3000)))
+			f.Close()
+			ioutil.WriteFile(journal+".tmp", []byte("torn"), 0644)
+		}
+		got, err := ioutil.ReadFile(newfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, newbs) {
+			t.Fatalf("%s: resumed patching after %v crashes does not reproduce the new file", test.name, crashes)
+		}
+		if _, err := os.Stat(journal); !os.IsNotExist(err) {
+			t.Error(test.name, "journal left behind:", err)
+		}
+	}
+
+	// A damaged journal starts over
+	patch, _ := bsdiff.Bytes(oldbs, newbs)
+	ioutil.WriteFile(patchfile, patch, 0644)
+	if crashed, _, _ := resumeCrashing(oldfile, newfile, patchfile, journal, int64(len(newbs)/2), opts...); !crashed {
+		t.Fatal("expected a crash")
+	}
+	j, err := ioutil.ReadFile(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j[50] ^= 1
+	ioutil.WriteFile(journal, j, 0644)
+	if _, first, err := resumeCrashing(oldfile, newfile, patchfile, journal, math.MaxInt64, opts...); err != nil || first > copyBuf {
+		t.Fatal("damaged journal: resumed at", first, err)
+	}
+	if got, _ := ioutil.ReadFile(newfile); !bytes.Equal(got, newbs) {
+		t.Fatal("patching after a damaged journal does not reproduce the new file")
+	}
+
+	// So does a well-formed journal that doesn't fit the patch, or whose
+	// checkpoint newfile doesn't hold
+	patch, _ = bsdiff.Bytes(oldbs, newbs, bsdiff.WithFormat(bsdiff.FormatExtended))
+	ioutil.WriteFile(patchfile, patch, 0644)
+	patchSum := sha256.Sum256(patch)
+	for _, done := range []int64{1 << 40, 100} {
+		j := append([]byte("BSPATCHJ"), patchSum[:]...)
+		for _, v := range []int64{0, 0, 0, 0, 0, done} {
+			j = binary.LittleEndian.AppendUint64(j, uint64(v))
+		}
+		j = binary.LittleEndian.AppendUint32(j, crc32.ChecksumIEEE(j))
+		ioutil.WriteFile(journal, j, 0644)
+		ioutil.WriteFile(newfile, bytes.Repeat([]byte{0xFF}, int(min64(done, 200))), 0644)
+		if err := Resume(oldfile, newfile, patchfile, journal, opts...); err != nil {
+			t.Fatal("stale journal:", done, err)
+		}
+		if got, _ := ioutil.ReadFile(newfile); !bytes.Equal(got, newbs) {
+			t.Fatal("patching after a stale journal does not reproduce the new file")
+		}
+	}
+
+	// Filtered patches are applied without checkpoints
+	oldexe, newexe := makeExecutable(nil), makeExecutable([]byte("inserted code"))
+	patch, err = bsdiff.Bytes(oldexe, newexe, bsdiff.WithFormat(bsdiff.FormatExtended), bsdiff.WithELFFilter(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(oldfile, oldexe, 0644)
+	ioutil.WriteFile(patchfile, patch, 0644)
+	if err := Resume(oldfile, newfile, patchfile, journal, opts...); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadFile(newfile); !bytes.Equal(got, newexe) {
+		t.Fatal("filtered patch does not reproduce the new file")
+	}
+}
@@ -0,0 +1,73 @@
+package bspatch
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"errors"
+)
+
+// signatureContext is the Ed25519ph context of patch signatures, as used by
+// bsdiff.Sign.
+const signatureContext = "go-bsdiff signed patch v1"
+
+// signatureSize is the size of a signature in a signed patch: a public key
+// and the signature it verifies.
+const signatureSize = ed25519.PublicKeySize + ed25519.SignatureSize
+
+// ErrUntrusted is returned when a signed patch carries no valid signature by
+// a trusted key.
+var ErrUntrusted = errors.New("patch is not signed by a trusted key")
+
+// Verify checks that patch, made by bsdiff.Sign, was signed by one of keys,
+// and returns the patch it holds. It fails with ErrUntrusted if none of its
+// signatures is a valid one by a trusted key, and with ErrBadMagic if patch
+// is not signed at all.
+func Verify(patch []byte, keys []ed25519.PublicKey) ([]byte, error) {
+	if !bytes.HasPrefix(patch, []byte("BSDIFFS1")[:min(len(patch), 8)]) {
+		return nil, wrapCorruptPatchError("incorrect magic number (signed header BSDIFFS1)", ErrBadMagic)
+	}
+	if len(patch) < 9 || len(patch) < 9+int(patch[8])*signatureSize {
+		return nil, wrapCorruptPatchError("signed patch ended early", ErrTruncated)
+	}
+	if patch[8] == 0 {
+		return nil, newCorruptPatchError("signed patch without signatures")
+	}
+	sigs := patch[9 : 9+int(patch[8])*signatureSize]
+	inner := patch[len(sigs)+9:]
+	digest := sha512.Sum512(inner)
+	opts := &ed25519.Options{Hash: crypto.SHA512, Context: signatureContext}
+	for ; len(sigs) > 0; sigs = sigs[signatureSize:] {
+		pub := ed25519.PublicKey(sigs[:ed25519.PublicKeySize])
+		for _, key := range keys {
+			// A key of the wrong size never equals pub, so it doesn't reach
+			// VerifyWithOptions, which would panic
+			if !pub.Equal(key) {
+				continue
+			}
+			if ed25519.VerifyWithOptions(pub, digest[:], sigs[ed25519.PublicKeySize:signatureSize], opts) == nil {
+				return inner, nil
+			}
+		}
+	}
+	return nil, ErrUntrusted
+}
+
+// VerifyAndApply verifies a patch made by bsdiff.Sign and applies the patch
+// it holds to oldfile. See Patcher.VerifyAndApply.
+func VerifyAndApply(oldfile, patch []byte, keys []ed25519.PublicKey, opts ...Option) ([]byte, error) {
+	return New(opts...).VerifyAndApply(oldfile, patch, keys)
+}
+
+// VerifyAndApply checks that patch was signed by one of keys with
+// bsdiff.Sign, as Verify does, and only then applies the patch it holds to
+// oldfile to create the newfile. Nothing is decompressed or written for a
+// patch that doesn't verify.
+func (p *Patcher) VerifyAndApply(oldfile, patch []byte, keys []ed25519.PublicKey) ([]byte, error) {
+	inner, err := Verify(patch, keys)
+	if err != nil {
+		return nil, err
+	}
+	return p.Bytes(oldfile, inner)
+}
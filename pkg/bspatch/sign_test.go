@@ -0,0 +1,77 @@
+package bspatch
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/kiteco/go-bsdiff/v2/pkg/bsdiff"
+)
+
+func TestVerifyAndApply(t *testing.T) {
+	oldbs := []byte("the old file, signed and verified")
+	newbs := []byte("the new file, signed and verified twice")
+	patch, err := bsdiff.Bytes(oldbs, newbs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rnd := rand.New(rand.NewSource(1))
+	pub, key, _ := ed25519.GenerateKey(rnd)
+	otherPub, _, _ := ed25519.GenerateKey(rnd)
+	signed, err := bsdiff.Sign(patch, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newbs2, err := VerifyAndApply(oldbs, signed, []ed25519.PublicKey{otherPub, pub})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(newbs, newbs2) {
+		t.Fatal("signed patch does not reproduce the new file")
+	}
+	if _, err := VerifyAndApply(oldbs, signed, []ed25519.PublicKey{otherPub}); !errors.Is(err, ErrUntrusted) {
+		t.Error("patch signed by an untrusted key: unexpected error", err)
+	}
+	tampered := append([]byte(nil), signed...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := VerifyAndApply(oldbs, tampered, []ed25519.PublicKey{pub}); !errors.Is(err, ErrUntrusted) {
+		t.Error("tampered patch: unexpected error", err)
+	}
+	if _, err := VerifyAndApply(oldbs, patch, []ed25519.PublicKey{pub}); !errors.Is(err, ErrBadMagic) {
+		t.Error("unsigned patch: unexpected error", err)
+	}
+}
+
+func TestVerifyCorrupt(t *testing.T) {
+	pub, _, _ := ed25519.GenerateKey(rand.New(rand.NewSource(1)))
+	keys := []ed25519.PublicKey{pub}
+	for _, test := range []struct {
+		name  string
+		patch []byte
+		err   error
+	}{
+		{"bad magic", patchfile, ErrBadMagic},
+		{"truncated header", []byte("BSDIFFS"), ErrTruncated},
+		{"truncated signatures", append([]byte("BSDIFFS1\x01"), make([]byte, 90)...), ErrTruncated},
+		{"no signatures", append([]byte("BSDIFFS1\x00"), patchfile...), nil},
+	} {
+		_, err := Verify(test.patch, keys)
+		var cerr CorruptPatchError
+		if !errors.As(err, &cerr) || test.err != nil && !errors.Is(err, test.err) {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+	}
+	// A signature by a trusted key must also verify
+	forged := append([]byte("BSDIFFS1\x01"), pub...)
+	forged = append(forged, make([]byte, ed25519.SignatureSize)...)
+	if _, err := Verify(append(forged, patchfile...), keys); err != ErrUntrusted {
+		t.Error("forged signature: unexpected error", err)
+	}
+	// Keys of the wrong size are never trusted
+	if _, err := Verify(append(forged, patchfile...), []ed25519.PublicKey{pub[:10]}); err != ErrUntrusted {
+		t.Error("short key: unexpected error", err)
+	}
+}
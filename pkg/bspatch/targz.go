@@ -0,0 +1,183 @@
+package bspatch
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"time"
+)
+
+// Flags of a tar.gz patch, as written by bsdiff.TarGz.
+const (
+	targzOld = 1 << iota
+	targzNew
+	targzExtra
+)
+
+// TarGz applies a patch made by bsdiff.TarGz to a gzip-compressed file. See
+// Patcher.TarGz.
+func TarGz(oldtgz, patch []byte, opts ...Option) ([]byte, error) {
+	return New(opts...).TarGz(oldtgz, patch)
+}
+
+// TarGz applies a patch made by bsdiff.TarGz to a gzip-compressed file,
+// usually a tarball. It decompresses the old file, applies the bsdiff patch
+// to the decompressed data and compresses the result with the gzip header
+// and level recorded in the patch. The result is checked against the new
+// file's SHA-256; if recompressing doesn't reproduce it, TarGz fails with
+// ErrNotReproducible.
+func (p *Patcher) TarGz(oldtgz, patch []byte) ([]byte, error) {
+	if !bytes.HasPrefix(patch, []byte("BSDIFFT1")[:min(len(patch), 8)]) {
+		return nil, wrapCorruptPatchError("incorrect magic number (tar.gz header BSDIFFT1)", ErrBadMagic)
+	}
+	if len(patch) < 8+sha256.Size+1 {
+		return nil, wrapCorruptPatchError("tar.gz patch ended early", ErrTruncated)
+	}
+	sum := patch[8 : 8+sha256.Size]
+	flags := patch[8+sha256.Size]
+	if flags&^(targzOld|targzNew|targzExtra) != 0 || flags&targzNew == 0 && flags != 0 {
+		return nil, newCorruptPatchError(fmt.Sprintf("invalid tar.gz patch flags %#x", flags))
+	}
+	r := bytes.NewReader(patch[8+sha256.Size+1:])
+	var hdr gzip.Header
+	var level int
+	if flags&targzNew != 0 {
+		var err error
+		if level, err = readGzipHeader(r, flags, &hdr); err != nil {
+			return nil, err
+		}
+	}
+
+	old := oldtgz
+	if flags&targzOld != 0 {
+		var err error
+		if old, err = p.gunzip(oldtgz); err != nil {
+			return nil, err
+		}
+	}
+	oldbs, err := readTarSegments(r, old)
+	if err != nil {
+		return nil, err
+	}
+	newbs, err := p.Bytes(oldbs, patch[len(patch)-r.Len():])
+	if err != nil {
+		return nil, err
+	}
+	if flags&targzNew != 0 {
+		var buf bytes.Buffer
+		zw, _ := gzip.NewWriterLevel(&buf, level)
+		zw.Header = hdr
+		zw.Write(newbs)
+		zw.Close()
+		newbs = buf.Bytes()
+	}
+	if actual := sha256.Sum256(newbs); !bytes.Equal(actual[:], sum) {
+		if flags&targzNew == 0 {
+			return nil, newChecksumError("newfile", sum, actual[:])
+		}
+		return nil, fmt.Errorf("%w: %w", ErrNotReproducible, newChecksumError("newfile", sum, actual[:]))
+	}
+	return newbs, nil
+}
+
+// readGzipHeader reads the gzip header and level recorded in a tar.gz patch.
+func readGzipHeader(r *bytes.Reader, flags byte, hdr *gzip.Header) (int, error) {
+	var b [2]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, targzError(err)
+	}
+	level := int(int8(b[0]))
+	if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		return 0, newCorruptPatchError(fmt.Sprintf("invalid gzip level %v", level))
+	}
+	hdr.OS = b[1]
+	mtime, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, targzError(err)
+	}
+	if mtime > math.MaxUint32 {
+		return 0, newCorruptPatchError("gzip modification time overflows")
+	}
+	if mtime > 0 {
+		hdr.ModTime = time.Unix(int64(mtime), 0)
+	}
+	fields := []*[]byte{new([]byte), new([]byte)}
+	if flags&targzExtra != 0 {
+		fields = append(fields, &hdr.Extra)
+	}
+	for _, f := range fields {
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return 0, targzError(err)
+		}
+		if n > uint64(r.Len()) {
+			return 0, wrapCorruptPatchError("tar.gz patch ended early", ErrTruncated)
+		}
+		*f = make([]byte, n)
+		r.Read(*f)
+	}
+	hdr.Name, hdr.Comment = string(*fields[0]), string(*fields[1])
+	return level, nil
+}
+
+func targzError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return wrapCorruptPatchError("tar.gz patch ended early", ErrTruncated)
+	}
+	return wrapCorruptPatchError("tar.gz patch: "+err.Error(), err)
+}
+
+// gunzip decompresses the old file, within the memory limit if one is set.
+func (p *Patcher) gunzip(oldtgz []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(oldtgz))
+	if err != nil {
+		return nil, fmt.Errorf("old file does not decompress: %w", ErrChecksumMismatch)
+	}
+	var src io.Reader = zr
+	if p.cfg.memLimit > 0 {
+		src = io.LimitReader(zr, p.cfg.memLimit+1)
+	}
+	data, err := ioutil.ReadAll(src)
+	if err != nil {
+		return nil, fmt.Errorf("old file does not decompress: %w", ErrChecksumMismatch)
+	}
+	if p.cfg.memLimit > 0 && int64(len(data)) > p.cfg.memLimit {
+		return nil, fmt.Errorf("old file decompresses to more than the memory limit: %w", ErrMemoryLimit)
+	}
+	return data, nil
+}
+
+// readTarSegments reads the segments of the old file recorded in a tar.gz
+// patch and concatenates them. They may be in any order but must not add
+// up to more than the old file.
+func readTarSegments(r *bytes.Reader, old []byte) ([]byte, error) {
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, targzError(err)
+	}
+	if count > uint64(r.Len()) {
+		return nil, wrapCorruptPatchError("tar.gz patch ended early", ErrTruncated)
+	}
+	size := uint64(len(old))
+	var out bytes.Buffer
+	for i := uint64(0); i < count; i++ {
+		off, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, targzError(err)
+		}
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, targzError(err)
+		}
+		if off > size || n > size-off || n > size-uint64(out.Len()) {
+			return nil, newCorruptPatchError("tar.gz segment out of range")
+		}
+		out.Write(old[off : off+n])
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,96 @@
+package bspatch
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/kiteco/go-bsdiff/v2/pkg/bsdiff"
+)
+
+// makeTarGz writes files to a tar stream compressed with compress/gzip at
+// level.
+func makeTarGz(t *testing.T, files []string, contents map[string]string, level int) []byte {
+	buf := new(bytes.Buffer)
+	zw, err := gzip.NewWriterLevel(buf, level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(zw)
+	for _, name := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(contents[name]))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(contents[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestTarGz(t *testing.T) {
+	contents := map[string]string{}
+	var files []string
+	for i := 0; i < 5; i++ {
+		name := fmt.Sprintf("usr/lib/lib%v.so", i)
+		contents[name] = strings.Repeat(fmt.Sprintf("symbol%v offset%v ", i, i*7), 500)
+		files = append(files, name)
+	}
+	oldtgz := makeTarGz(t, files, contents, gzip.DefaultCompression)
+	contents["usr/lib/lib3.so"] = strings.Replace(contents["usr/lib/lib3.so"], "symbol3", "symbol4", 10)
+	for _, level := range []int{gzip.DefaultCompression, gzip.BestCompression} {
+		newtgz := makeTarGz(t, files, contents, level)
+		patch, err := bsdiff.TarGz(oldtgz, newtgz)
+		if err != nil {
+			t.Fatal(err)
+		}
+		newtgz2, err := TarGz(oldtgz, patch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(newtgz, newtgz2) {
+			t.Fatal("tar.gz patch does not reproduce the new file")
+		}
+
+		// Recompressing at the wrong level can't reproduce the file
+		bad := append([]byte{}, patch...)
+		bad[41] = byte(gzip.NoCompression)
+		if _, err := TarGz(oldtgz, bad); !errors.Is(err, ErrNotReproducible) {
+			t.Fatal("expected ErrNotReproducible, got", err)
+		}
+	}
+}
+
+func TestTarGzCorrupt(t *testing.T) {
+	header := append([]byte("BSDIFFT1"), make([]byte, sha256.Size)...)
+	header = header[:len(header):len(header)]
+	for _, test := range []struct {
+		name  string
+		patch []byte
+		err   error
+	}{
+		{"bad magic", patchfile, ErrBadMagic},
+		{"truncated header", header[:20], ErrTruncated},
+		{"invalid flags", append(header, 8), nil},
+		{"invalid level", append(header, 2, 20, 0, 0, 0, 0), nil},
+		{"truncated name", append(header, 2, 0, 0, 0, 5, 'a'), ErrTruncated},
+		{"segment out of range", append(header, 0, 1, 0, 200, 1), nil},
+	} {
+		_, err := TarGz(oldfile, test.patch)
+		var cerr CorruptPatchError
+		if !errors.As(err, &cerr) || test.err != nil && !errors.Is(err, test.err) {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package bspatch
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// ErrNotReproducible is matched by errors.Is when an archive can't be
+// recompressed to the exact bytes recorded in a patch, for example because
+// the compressor behaves differently in this version of Go. No output is
+// produced in that case.
+var ErrNotReproducible = errors.New("archive can't be recompressed byte for byte")
+
+// zipEntry is a deflated entry of an archive recorded in a zip patch.
+type zipEntry struct {
+	off, size, usize int64
+	level            int
+}
+
+// readZipEntries reads the entries recorded in a zip patch. Entries must
+// be in order, must not overlap and must lie within size bytes.
+func readZipEntries(r *bytes.Reader, withLevel bool, size int64) ([]zipEntry, error) {
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, zipError(err)
+	}
+	var entries []zipEntry
+	var end int64
+	for i := uint64(0); i < count; i++ {
+		var e zipEntry
+		var v [3]uint64
+		n := 2
+		if withLevel {
+			n = 3
+		}
+		for j := 0; j < n; j++ {
+			if v[j], err = binary.ReadUvarint(r); err != nil {
+				return nil, zipError(err)
+			}
+			if v[j] > math.MaxInt64/4 {
+				return nil, newCorruptPatchError("zip entry size overflows")
+			}
+		}
+		e.off, e.size, e.usize = int64(v[0]), int64(v[1]), int64(v[2])
+		if withLevel {
+			level, err := r.ReadByte()
+			if err != nil {
+				return nil, zipError(err)
+			}
+			e.level = int(int8(level))
+			if e.level < flate.HuffmanOnly || e.level > flate.BestCompression {
+				return nil, newCorruptPatchError(fmt.Sprintf("invalid deflate level %v", e.level))
+			}
+		}
+		if e.off < end || size >= 0 && e.off+e.size > size {
+			return nil, newCorruptPatchError("zip entries out of order or out of range")
+		}
+		end = e.off + e.size
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func zipError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return wrapCorruptPatchError("zip patch ended early", ErrTruncated)
+	}
+	return wrapCorruptPatchError("zip patch: "+err.Error(), err)
+}
+
+// Zip applies a patch made by bsdiff.Zip to an archive. See Patcher.Zip.
+func Zip(oldzip, patch []byte, opts ...Option) ([]byte, error) {
+	return New(opts...).Zip(oldzip, patch)
+}
+
+// Zip applies a patch made by bsdiff.Zip to an archive. It inflates the
+// old archive's entries listed in the patch, applies the bsdiff patch that
+// follows and recompresses the new archive's entries. The result is checked
+// against the new archive's SHA-256; if recompressing doesn't reproduce it,
+// Zip fails with ErrNotReproducible. With WithMemoryLimit, Zip fails with
+// ErrMemoryLimit if the inflated old archive is larger than the limit.
+func (p *Patcher) Zip(oldzip, patch []byte) ([]byte, error) {
+	if !bytes.HasPrefix(patch, []byte("BSDIFFZ1")[:min(len(patch), 8)]) {
+		return nil, wrapCorruptPatchError("incorrect magic number (zip header BSDIFFZ1)", ErrBadMagic)
+	}
+	if len(patch) < 8+sha256.Size {
+		return nil, wrapCorruptPatchError("zip patch ended early", ErrTruncated)
+	}
+	sum := patch[8 : 8+sha256.Size]
+	r := bytes.NewReader(patch[8+sha256.Size:])
+	oldEntries, err := readZipEntries(r, false, int64(len(oldzip)))
+	if err != nil {
+		return nil, err
+	}
+	newEntries, err := readZipEntries(r, true, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	oldx, err := p.inflateEntries(oldzip, oldEntries)
+	if err != nil {
+		return nil, err
+	}
+	newx, err := p.Bytes(oldx, patch[len(patch)-r.Len():])
+	if err != nil {
+		return nil, err
+	}
+	newzip, err := deflateEntries(newx, newEntries)
+	if err != nil {
+		return nil, err
+	}
+	if actual := sha256.Sum256(newzip); !bytes.Equal(actual[:], sum) {
+		return nil, fmt.Errorf("%w: %w", ErrNotReproducible, newChecksumError("newfile", sum, actual[:]))
+	}
+	return newzip, nil
+}
+
+// inflateEntries replaces the compressed data of each entry of the old
+// archive with its inflated data. With WithMemoryLimit, it fails with
+// ErrMemoryLimit if the result would be larger than the limit.
+func (p *Patcher) inflateEntries(archive []byte, entries []zipEntry) ([]byte, error) {
+	var out bytes.Buffer
+	var pos int64
+	tooLarge := func() bool {
+		return p.cfg.memLimit > 0 && int64(out.Len()) > p.cfg.memLimit
+	}
+	for _, e := range entries {
+		out.Write(archive[pos:e.off])
+		if tooLarge() {
+			break
+		}
+		br := bytes.NewReader(archive[e.off : e.off+e.size])
+		fr := flate.NewReader(br)
+		var src io.Reader = fr
+		if p.cfg.memLimit > 0 {
+			src = io.LimitReader(fr, p.cfg.memLimit-int64(out.Len())+1)
+		}
+		_, err := io.Copy(&out, src)
+		fr.Close()
+		if tooLarge() {
+			break
+		}
+		if err != nil || br.Len() != 0 {
+			return nil, fmt.Errorf("old archive entry at offset %v does not inflate: %w", e.off, ErrChecksumMismatch)
+		}
+		pos = e.off + e.size
+	}
+	if !tooLarge() {
+		out.Write(archive[pos:])
+	}
+	if tooLarge() {
+		return nil, fmt.Errorf("old archive inflates to more than the memory limit: %w", ErrMemoryLimit)
+	}
+	return out.Bytes(), nil
+}
+
+// deflateEntries compresses the inflated entries of the new archive back to
+// their recorded sizes.
+func deflateEntries(expanded []byte, entries []zipEntry) ([]byte, error) {
+	var out bytes.Buffer
+	// pos is the position in expanded and shift how much longer expanded is
+	// up to there than the archive
+	var pos, shift int64
+	writers := map[int]*flate.Writer{}
+	for _, e := range entries {
+		start := e.off + shift
+		if start < pos || e.usize > int64(len(expanded))-start {
+			return nil, newCorruptPatchError("zip entry out of range")
+		}
+		out.Write(expanded[pos:start])
+		n := int64(out.Len())
+		fw := writers[e.level]
+		if fw == nil {
+			fw, _ = flate.NewWriter(&out, e.level)
+			writers[e.level] = fw
+		} else {
+			fw.Reset(&out)
+		}
+		fw.Write(expanded[start : start+e.usize])
+		fw.Close()
+		if int64(out.Len())-n != e.size {
+			return nil, fmt.Errorf("%w: entry at offset %v recompressed to %v bytes instead of %v", ErrNotReproducible, e.off, int64(out.Len())-n, e.size)
+		}
+		pos = start + e.usize
+		shift += e.usize - e.size
+	}
+	out.Write(expanded[pos:])
+	return out.Bytes(), nil
+}
@@ -0,0 +1,96 @@
+package bspatch
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/kiteco/go-bsdiff/v2/pkg/bsdiff"
+)
+
+// makeZip writes files to a zip archive with deflate.
+func makeZip(t *testing.T, files []string, contents map[string]string) []byte {
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	for _, name := range files {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(contents[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestZip(t *testing.T) {
+	contents := map[string]string{}
+	var files []string
+	for i := 0; i < 5; i++ {
+		name := fmt.Sprintf("com/example/Class%v.class", i)
+		contents[name] = strings.Repeat(fmt.Sprintf("method%v field%v ", i, i*7), 500)
+		files = append(files, name)
+	}
+	oldzip := makeZip(t, files, contents)
+	contents["com/example/Class3.class"] = strings.Replace(contents["com/example/Class3.class"], "method3", "method4", 10)
+	newzip := makeZip(t, files, contents)
+	patch, err := bsdiff.Zip(oldzip, newzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newzip2, err := Zip(oldzip, patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(newzip, newzip2) {
+		t.Fatal("zip patch does not reproduce the new archive")
+	}
+
+	// The old entries are inflated in memory
+	if _, err := New(WithMemoryLimit(int64(len(oldzip)))).Zip(oldzip, patch); !errors.Is(err, ErrMemoryLimit) {
+		t.Fatal("expected ErrMemoryLimit, got", err)
+	}
+
+	// Recompressing at the wrong level can't reproduce the archive
+	r := bytes.NewReader(patch[40:])
+	n, _ := binary.ReadUvarint(r)
+	for i := uint64(0); i < 2*n+1+3; i++ {
+		binary.ReadUvarint(r)
+	}
+	bad := append([]byte{}, patch...)
+	bad[len(patch)-r.Len()] = byte(flate.NoCompression)
+	if _, err := Zip(oldzip, bad); !errors.Is(err, ErrNotReproducible) {
+		t.Fatal("expected ErrNotReproducible, got", err)
+	}
+}
+
+func TestZipCorrupt(t *testing.T) {
+	header := append([]byte("BSDIFFZ1"), make([]byte, sha256.Size)...)
+	for _, test := range []struct {
+		name  string
+		patch []byte
+		err   error
+	}{
+		{"bad magic", patchfile, ErrBadMagic},
+		{"truncated header", header[:20], ErrTruncated},
+		{"truncated entries", append(header, 1, 0), ErrTruncated},
+		{"old entry out of range", append(header, 1, 0, 200, 0), nil},
+		{"invalid level", append(header, 0, 1, 0, 2, 2, 20), nil},
+	} {
+		_, err := Zip(oldfile, test.patch)
+		var cerr CorruptPatchError
+		if !errors.As(err, &cerr) || test.err != nil && !errors.Is(err, test.err) {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// Package checksum provides the digest algorithms a patch can use to verify
+// the old and new files.
+package checksum
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"hash/crc32"
+)
+
+// Algorithm identifies a digest algorithm in a patch header.
+type Algorithm byte
+
+// Algorithms are stored in patches, so their values must never change.
+const (
+	// SHA256 is the default and the only algorithm the BSDIFF40 layouts
+	// can record.
+	SHA256 Algorithm = 0
+	SHA512 Algorithm = 1
+	// CRC32C is much faster to compute but only guards against accidental
+	// corruption.
+	CRC32C Algorithm = 2
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// New returns a new hash.Hash computing the algorithm's digest.
+func (a Algorithm) New() (hash.Hash, error) {
+	switch a {
+	case SHA256:
+		return sha256.New(), nil
+	case SHA512:
+		return sha512.New(), nil
+	case CRC32C:
+		return crc32.New(crc32c), nil
+	}
+	return nil, fmt.Errorf("checksum: unknown algorithm %v", byte(a))
+}
+
+// Size returns the length of the algorithm's digest in bytes, or 0 if the
+// algorithm is unknown.
+func (a Algorithm) Size() int {
+	switch a {
+	case SHA256:
+		return sha256.Size
+	case SHA512:
+		return sha512.Size
+	case CRC32C:
+		return crc32.Size
+	}
+	return 0
+}
+
+// Sum returns the algorithm's digest of b.
+func (a Algorithm) Sum(b []byte) ([]byte, error) {
+	h, err := a.New()
+	if err != nil {
+		return nil, err
+	}
+	h.Write(b)
+	return h.Sum(nil), nil
+}
+
+func (a Algorithm) String() string {
+	switch a {
+	case SHA256:
+		return "sha256"
+	case SHA512:
+		return "sha512"
+	case CRC32C:
+		return "crc32c"
+	}
+	return fmt.Sprintf("checksum(%v)", byte(a))
+}
+
+// Parse returns the algorithm with the given name.
+func Parse(name string) (Algorithm, error) {
+	for _, a := range []Algorithm{SHA256, SHA512, CRC32C} {
+		if a.String() == name {
+			return a, nil
+		}
+	}
+	return 0, fmt.Errorf("checksum: unknown algorithm %q", name)
+}
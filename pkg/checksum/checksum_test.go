@@ -0,0 +1,44 @@
+package checksum
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestAlgorithms(t *testing.T) {
+	tests := []struct {
+		a      Algorithm
+		digest string
+	}{
+		{SHA256, "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{SHA512, "ddaf35a193617abacc417349ae20413112e6fa4e89a97ea20a9eeee64b55d39a2192992a274fc1a836ba3c23a3feebbd454d4423643ce80e2a9ac94fa54ca49f"},
+		{CRC32C, "364b3fb7"},
+	}
+	for _, test := range tests {
+		sum, err := test.a.Sum([]byte("abc"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, _ := hex.DecodeString(test.digest)
+		if !bytes.Equal(sum, expected) {
+			t.Errorf("%v: expected %x, got %x", test.a, expected, sum)
+		}
+		if len(sum) != test.a.Size() {
+			t.Errorf("%v: Size %v != %v", test.a, test.a.Size(), len(sum))
+		}
+		a, err := Parse(test.a.String())
+		if err != nil || a != test.a {
+			t.Errorf("%v: Parse returned %v, %v", test.a, a, err)
+		}
+	}
+	if _, err := Algorithm(99).New(); err == nil {
+		t.Error("unknown algorithm should fail")
+	}
+	if Algorithm(99).Size() != 0 {
+		t.Error("unknown algorithm should have size 0")
+	}
+	if _, err := Parse("md5"); err == nil {
+		t.Error("unknown name should fail")
+	}
+}
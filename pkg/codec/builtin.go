@@ -0,0 +1,139 @@
+package codec
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+
+	"github.com/andybalholm/brotli"
+	"github.com/dsnet/compress/bzip2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+func init() {
+	Register(None, "none", noneCodec{})
+	Register(Bzip2, "bzip2", bzip2Codec{})
+	Register(Gzip, "gzip", gzipCodec{})
+	Register(Zstd, "zstd", zstdCodec{})
+	Register(XZ, "xz", xzCodec{})
+	Register(Brotli, "brotli", brotliCodec{})
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// noneCodec stores blocks uncompressed.
+type noneCodec struct{}
+
+func (noneCodec) NewWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+func (noneCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(r), nil
+}
+
+// bzip2Codec is the codec of bsdiff 4. Like the bzip2 command, it
+// defaults to the best compression.
+type bzip2Codec struct{}
+
+func (bzip2Codec) NewWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	if level == DefaultLevel {
+		level = bzip2.BestCompression
+	}
+	return bzip2.NewWriter(w, &bzip2.WriterConfig{Level: level})
+}
+
+func (bzip2Codec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return bzip2.NewReader(r, nil)
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) NewWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	if level == DefaultLevel {
+		level = gzip.DefaultCompression
+	}
+	return gzip.NewWriterLevel(w, level)
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// scaleLevel maps level, from BestSpeed to BestCompression, linearly onto
+// the range from lo to hi. Levels outside that range are clamped.
+func scaleLevel(level, lo, hi int) int {
+	if level < BestSpeed {
+		level = BestSpeed
+	} else if level > BestCompression {
+		level = BestCompression
+	}
+	const steps = BestCompression - BestSpeed
+	return lo + ((level-BestSpeed)*(hi-lo)+steps/2)/steps
+}
+
+// zstdCodec maps levels onto the encoder's four, from SpeedFastest to
+// SpeedBestCompression.
+type zstdCodec struct{}
+
+func (zstdCodec) NewWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	el := zstd.SpeedDefault
+	if level != DefaultLevel {
+		el = zstd.EncoderLevel(scaleLevel(level, int(zstd.SpeedFastest), int(zstd.SpeedBestCompression)))
+	}
+	return zstd.NewWriter(w, zstd.WithEncoderLevel(el), zstd.WithEncoderConcurrency(1))
+}
+
+func (zstdCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return d.IOReadCloser(), nil
+}
+
+// xzDictCaps are the dictionary sizes of the xz command's presets 0-9.
+var xzDictCaps = [10]int{
+	256 << 10, 1 << 20, 2 << 20, 4 << 20, 4 << 20,
+	8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20,
+}
+
+// xzCodec uses the dictionary size of the xz preset of the same number.
+type xzCodec struct{}
+
+func (xzCodec) NewWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	cfg := xz.WriterConfig{}
+	if level > DefaultLevel && level <= BestCompression {
+		cfg.DictCap = xzDictCaps[level]
+	}
+	return cfg.NewWriter(w)
+}
+
+func (xzCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	xr, err := xz.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(xr), nil
+}
+
+// brotliCodec maps levels onto brotli's, from 0 to 11.
+type brotliCodec struct{}
+
+func (brotliCodec) NewWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	if level == DefaultLevel {
+		level = brotli.DefaultCompression
+	} else {
+		level = scaleLevel(level, brotli.BestSpeed, brotli.BestCompression)
+	}
+	return brotli.NewWriterLevel(w, level), nil
+}
+
+func (brotliCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(brotli.NewReader(r)), nil
+}
@@ -0,0 +1,104 @@
+// Package codec provides the compression codecs used for the control, diff
+// and extra blocks of a patch.
+package codec
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ID identifies a codec in a patch header.
+type ID byte
+
+// Built-in codecs. IDs are stored in patches, so they must never change.
+const (
+	None   ID = 0
+	Bzip2  ID = 1
+	Gzip   ID = 2
+	Zstd   ID = 3
+	XZ     ID = 4
+	Brotli ID = 5
+)
+
+// Compression levels understood by every codec. gzip and bzip2 use levels
+// from BestSpeed to BestCompression as they are, and xz uses the dictionary
+// size of its preset of the same number. zstd and brotli map them linearly
+// onto their own scales, from 1 to 4 and from 0 to 11. DefaultLevel is each
+// codec's own default.
+const (
+	DefaultLevel    = 0
+	BestSpeed       = 1
+	BestCompression = 9
+)
+
+// Compressor creates writers that compress everything written to them.
+type Compressor interface {
+	// NewWriter returns a writer that compresses to w at the given level.
+	// Closing it flushes the compressed stream but does not close w.
+	NewWriter(w io.Writer, level int) (io.WriteCloser, error)
+}
+
+// Decompressor creates readers that decompress a stream.
+type Decompressor interface {
+	// NewReader returns a reader that decompresses r. Closing it does not
+	// close r.
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// Codec is a Compressor and its matching Decompressor.
+type Codec interface {
+	Compressor
+	Decompressor
+}
+
+type entry struct {
+	name  string
+	codec Codec
+}
+
+var (
+	mu       sync.RWMutex
+	registry = map[ID]entry{}
+)
+
+// Register makes a codec available under id and name, replacing any codec
+// previously registered under id.
+func Register(id ID, name string, c Codec) {
+	mu.Lock()
+	defer mu.Unlock()
+	registry[id] = entry{name, c}
+}
+
+// Get returns the codec registered under id.
+func Get(id ID) (Codec, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	e, ok := registry[id]
+	if !ok {
+		return nil, fmt.Errorf("codec: unknown codec %v", byte(id))
+	}
+	return e.codec, nil
+}
+
+// Parse returns the ID of the codec registered under name.
+func Parse(name string) (ID, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	for id, e := range registry {
+		if e.name == name {
+			return id, nil
+		}
+	}
+	return 0, fmt.Errorf("codec: unknown codec %q", name)
+}
+
+// String returns the name id was registered under.
+func (id ID) String() string {
+	mu.RLock()
+	defer mu.RUnlock()
+	if e, ok := registry[id]; ok {
+		return e.name
+	}
+	return fmt.Sprintf("codec(%v)", byte(id))
+}
@@ -0,0 +1,152 @@
+package codec
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestCodecs(t *testing.T) {
+	data := bytes.Repeat([]byte("bsdiff codec round trip "), 1000)
+	for _, id := range []ID{None, Bzip2, Gzip, Zstd, XZ, Brotli} {
+		c, err := Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, level := range []int{DefaultLevel, BestSpeed, BestCompression} {
+			buf := new(bytes.Buffer)
+			w, err := c.NewWriter(buf, level)
+			if err != nil {
+				t.Fatalf("%v level %v: %v", id, level, err)
+			}
+			if _, err := w.Write(data); err != nil {
+				t.Fatalf("%v level %v: %v", id, level, err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("%v level %v: %v", id, level, err)
+			}
+
+			r, err := c.NewReader(buf)
+			if err != nil {
+				t.Fatalf("%v level %v: %v", id, level, err)
+			}
+			out, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("%v level %v: %v", id, level, err)
+			}
+			r.Close()
+			if !bytes.Equal(out, data) {
+				t.Fatalf("%v level %v: round trip mismatch", id, level)
+			}
+		}
+	}
+}
+
+func TestScaleLevel(t *testing.T) {
+	for _, test := range []struct {
+		level, lo, hi, want int
+	}{
+		{BestSpeed, 0, 11, 0},
+		{5, 0, 11, 6},
+		{BestCompression, 0, 11, 11},
+		{BestSpeed, 1, 4, 1},
+		{5, 1, 4, 3},
+		{BestCompression, 1, 4, 4},
+		{BestCompression + 3, 1, 4, 4},
+		{-1, 0, 11, 0},
+	} {
+		if got := scaleLevel(test.level, test.lo, test.hi); got != test.want {
+			t.Errorf("scaleLevel(%v, %v, %v) = %v, want %v", test.level, test.lo, test.hi, got, test.want)
+		}
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	for _, name := range []string{"none", "bzip2", "gzip", "zstd", "xz", "brotli"} {
+		id, err := Parse(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id.String() != name {
+			t.Fatal(id.String(), "!=", name)
+		}
+	}
+	if _, err := Parse("lz4"); err == nil {
+		t.Fatal("unknown name should fail")
+	}
+	if _, err := Get(200); err == nil {
+		t.Fatal("unknown id should fail")
+	}
+	if ID(200).String() != "codec(200)" {
+		t.Fatal(ID(200).String())
+	}
+
+	Register(200, "custom", noneCodec{})
+	defer func() {
+		mu.Lock()
+		delete(registry, 200)
+		mu.Unlock()
+	}()
+	if _, err := Get(200); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConcurrentCompressors(t *testing.T) {
+	data := bytes.Repeat([]byte("bsdiff concurrent compression "), 1000)
+	for _, id := range []ID{Bzip2, Zstd} {
+		c, err := Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cc, ok := c.(ConcurrentCompressor)
+		if !ok {
+			t.Fatalf("%v is not a ConcurrentCompressor", id)
+		}
+
+		// Inputs of one segment match NewWriter
+		serial, concurrent := new(bytes.Buffer), new(bytes.Buffer)
+		w, _ := c.NewWriter(serial, BestSpeed)
+		w.Write(data)
+		w.Close()
+		w, err = cc.NewConcurrentWriter(concurrent, BestSpeed, 4)
+		if err != nil {
+			t.Fatal(id, err)
+		}
+		w.Write(data)
+		if err := w.Close(); err != nil {
+			t.Fatal(id, err)
+		}
+		if !bytes.Equal(serial.Bytes(), concurrent.Bytes()) {
+			t.Fatalf("%v: single segment differs from NewWriter", id)
+		}
+
+		// Larger inputs are split into concatenated streams
+		for _, n := range []int{1, 3} {
+			buf := new(bytes.Buffer)
+			sw := newSegmentWriter(buf, n, 7000, func(w io.Writer) (io.WriteCloser, error) {
+				return c.NewWriter(w, BestSpeed)
+			})
+			for p := data; len(p) > 0; p = p[min(len(p), 999):] {
+				if _, err := sw.Write(p[:min(len(p), 999)]); err != nil {
+					t.Fatal(id, err)
+				}
+			}
+			if err := sw.Close(); err != nil {
+				t.Fatal(id, err)
+			}
+			r, err := c.NewReader(buf)
+			if err != nil {
+				t.Fatal(id, err)
+			}
+			out, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(id, n, err)
+			}
+			if !bytes.Equal(out, data) {
+				t.Fatalf("%v, %v goroutines: round trip mismatch", id, n)
+			}
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package codec
+
+import (
+	"bytes"
+	"io"
+)
+
+// SegmentSize is the amount of input a ConcurrentCompressor compresses
+// into each independent stream.
+const SegmentSize = 4 << 20
+
+// ConcurrentCompressor is implemented by codecs whose streams can be
+// concatenated, so a large input can be compressed on several goroutines.
+// The built-in bzip2 and zstd codecs implement it.
+type ConcurrentCompressor interface {
+	// NewConcurrentWriter is like NewWriter, but splits the input into
+	// segments of SegmentSize bytes, compresses up to n of them at once
+	// and writes the compressed streams to w one after another. Inputs of
+	// up to SegmentSize bytes are compressed exactly as by NewWriter.
+	NewConcurrentWriter(w io.Writer, level, n int) (io.WriteCloser, error)
+}
+
+func (c bzip2Codec) NewConcurrentWriter(w io.Writer, level, n int) (io.WriteCloser, error) {
+	return newSegmentWriter(w, n, SegmentSize, func(w io.Writer) (io.WriteCloser, error) {
+		return c.NewWriter(w, level)
+	}), nil
+}
+
+func (c zstdCodec) NewConcurrentWriter(w io.Writer, level, n int) (io.WriteCloser, error) {
+	return newSegmentWriter(w, n, SegmentSize, func(w io.Writer) (io.WriteCloser, error) {
+		return c.NewWriter(w, level)
+	}), nil
+}
+
+// segment is one part of the input of a segmentWriter being compressed.
+type segment struct {
+	in   []byte
+	out  bytes.Buffer
+	err  error
+	done chan struct{}
+}
+
+// segmentWriter compresses each segment of its input on its own goroutine
+// and writes the results in order.
+type segmentWriter struct {
+	w         io.Writer
+	size      int
+	newWriter func(io.Writer) (io.WriteCloser, error)
+	// pending holds up to n segments in the order they were started.
+	pending []*segment
+	n       int
+	cur     []byte
+	started bool
+	err     error
+}
+
+func newSegmentWriter(w io.Writer, n, size int, newWriter func(io.Writer) (io.WriteCloser, error)) *segmentWriter {
+	if n < 1 {
+		n = 1
+	}
+	return &segmentWriter{w: w, size: size, newWriter: newWriter, n: n}
+}
+
+func (s *segmentWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		if s.err != nil {
+			return written, s.err
+		}
+		if len(s.cur) == s.size {
+			s.start()
+		}
+		if s.cur == nil {
+			s.cur = make([]byte, 0, s.size)
+		}
+		m := copy(s.cur[len(s.cur):s.size], p)
+		s.cur = s.cur[:len(s.cur)+m]
+		p = p[m:]
+		written += m
+	}
+	return written, s.err
+}
+
+// start compresses the current segment on a new goroutine, first writing
+// out the oldest segment if n are already pending.
+func (s *segmentWriter) start() {
+	if len(s.pending) == s.n {
+		s.finish()
+	}
+	seg := &segment{in: s.cur, done: make(chan struct{})}
+	s.cur = nil
+	s.started = true
+	s.pending = append(s.pending, seg)
+	go func() {
+		defer close(seg.done)
+		zw, err := s.newWriter(&seg.out)
+		if err == nil {
+			if _, err = zw.Write(seg.in); err == nil {
+				err = zw.Close()
+			}
+		}
+		seg.err = err
+		seg.in = nil
+	}()
+}
+
+// finish waits for the oldest pending segment and writes it out.
+func (s *segmentWriter) finish() {
+	seg := s.pending[0]
+	s.pending = s.pending[1:]
+	<-seg.done
+	if s.err != nil {
+		return
+	}
+	if s.err = seg.err; s.err == nil {
+		_, s.err = seg.out.WriteTo(s.w)
+	}
+}
+
+// Close compresses the rest of the input and writes out every segment. An
+// empty input is written as one empty stream.
+func (s *segmentWriter) Close() error {
+	if len(s.cur) > 0 || !s.started {
+		s.start()
+	}
+	for len(s.pending) > 0 {
+		s.finish()
+	}
+	return s.err
+}
@@ -0,0 +1,345 @@
+// Package filter provides the reversible transforms a patch can apply to
+// executables before they are diffed.
+//
+// Calls and jumps to the same function have different displacements at
+// each site, so when code moves but the functions it branches to don't,
+// bsdiff emits diff bytes for every branch in it. The filters rewrite the
+// displacements of backward calls as absolute target addresses, which stay
+// the same when the call site moves. That is the common case in a new
+// build: changed code moves everything linked after it, including the
+// calls it makes into the runtime and libraries linked before it. Forward
+// calls, mostly between functions that moved together, keep their
+// displacements. Jumps of 64 KiB or more, such as tail calls, become their
+// targets in either direction; shorter ones mostly stay within a function
+// and move with their targets, so they are left alone. bspatch rewrites
+// the branches back after patching. Only the executable segments of 64-bit
+// little-endian ELF files are filtered.
+//
+// The filters convert CALL (E8) and JMP (E9) with rel32 displacements on
+// x86-64, and BL and B on AArch64.
+package filter
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// ID identifies a filter in a patch header.
+type ID byte
+
+// IDs are stored in patches, so their values must never change.
+const (
+	// None leaves files as they are.
+	None ID = 0
+	// X86_64 converts the rel32 displacements of CALL (E8) and JMP (E9)
+	// instructions in x86-64 code.
+	X86_64 ID = 1
+	// ARM64 converts the imm26 offsets of BL and B instructions in AArch64
+	// code.
+	ARM64 ID = 2
+)
+
+// ELF machine numbers.
+const (
+	emX86_64  = 62
+	emAArch64 = 183
+)
+
+// Jumps shorter than these, in bytes on x86-64 and in instructions on
+// AArch64, keep their displacements; see remapJump.
+const (
+	x86JumpReach   = 64 << 10
+	arm64JumpReach = 16 << 10
+)
+
+// maxHeaderSize bounds where an ELF file's program headers may end for it
+// to be filtered, so that a decoder only buffers that much.
+const maxHeaderSize = 64 << 10
+
+// Detect returns the filter for the ELF executable b, or None if b is not a
+// 64-bit little-endian ELF file for x86-64 or AArch64.
+func Detect(b []byte) ID {
+	if len(b) < 64 || string(b[:4]) != "\x7fELF" || b[4] != 2 || b[5] != 1 {
+		return None
+	}
+	switch binary.LittleEndian.Uint16(b[18:]) {
+	case emX86_64:
+		return X86_64
+	case emAArch64:
+		return ARM64
+	}
+	return None
+}
+
+// Valid reports whether id is a known filter.
+func (id ID) Valid() bool {
+	return id <= ARM64
+}
+
+func (id ID) String() string {
+	switch id {
+	case None:
+		return "none"
+	case X86_64:
+		return "x86-64"
+	case ARM64:
+		return "arm64"
+	}
+	return fmt.Sprintf("filter(%v)", byte(id))
+}
+
+// segment is an executable range of a file and its virtual address.
+type segment struct {
+	off, end int64
+	vaddr    uint64
+}
+
+// segments returns the executable segments of the ELF file whose first
+// bytes are b, if it is one for id's machine. Segments are clipped so that
+// they don't include the ELF and program headers, and don't overlap. If b
+// is too short to tell, ok is false.
+func segments(b []byte, id ID) (segs []segment, ok bool) {
+	if len(b) < 64 {
+		return nil, false
+	}
+	if Detect(b) != id || id == None {
+		return nil, true
+	}
+	phoff := binary.LittleEndian.Uint64(b[32:])
+	phentsize := uint64(binary.LittleEndian.Uint16(b[54:]))
+	phnum := uint64(binary.LittleEndian.Uint16(b[56:]))
+	if phentsize < 56 || phoff > maxHeaderSize {
+		return nil, true
+	}
+	hdrEnd := phoff + phnum*phentsize
+	if hdrEnd > maxHeaderSize {
+		return nil, true
+	}
+	if uint64(len(b)) < hdrEnd {
+		return nil, false
+	}
+	hdrEnd = max(hdrEnd, 64)
+	for i := uint64(0); i < phnum; i++ {
+		ph := b[phoff+i*phentsize:]
+		const ptLoad, pfX = 1, 1
+		if binary.LittleEndian.Uint32(ph) != ptLoad || binary.LittleEndian.Uint32(ph[4:])&pfX == 0 {
+			continue
+		}
+		off := binary.LittleEndian.Uint64(ph[8:])
+		vaddr := binary.LittleEndian.Uint64(ph[16:])
+		filesz := binary.LittleEndian.Uint64(ph[32:])
+		end := off + filesz
+		if end < off || end > 1<<62 {
+			continue
+		}
+		if off < hdrEnd {
+			if end <= hdrEnd {
+				continue
+			}
+			vaddr += hdrEnd - off
+			off = hdrEnd
+		}
+		segs = append(segs, segment{int64(off), int64(end), vaddr})
+	}
+	sort.Slice(segs, func(i, j int) bool { return segs[i].off < segs[j].off })
+	kept := segs[:0]
+	var end int64
+	for _, s := range segs {
+		if s.off >= end {
+			kept = append(kept, s)
+			end = s.end
+		}
+	}
+	return kept, true
+}
+
+// convert filters or unfilters b, which starts at offset pos of the file,
+// from the instruction at offset next on. It returns the offset of the
+// first instruction it could not convert because it extends past b; all
+// bytes before it are final.
+func convert(id ID, segs []segment, b []byte, pos, next int64, decode bool) int64 {
+	bend := pos + int64(len(b))
+	i := max(next, pos)
+	for _, s := range segs {
+		if s.end <= i {
+			continue
+		}
+		if s.off >= bend {
+			break
+		}
+		i = max(i, s.off)
+		switch id {
+		case X86_64:
+			for i < s.end && i < bend {
+				op := b[i-pos]
+				if op != 0xE8 && op != 0xE9 || i+5 > s.end {
+					i++
+					continue
+				}
+				if i+5 > bend {
+					return i
+				}
+				// Only displacements within 16 MiB are converted, to
+				// values in the same range, so the decoder finds them
+				v := binary.LittleEndian.Uint32(b[i+1-pos:])
+				if top := v >> 24; top == 0 || top == 0xFF {
+					// The displacement is relative to the next instruction
+					site := int32(s.vaddr+uint64(i+5-s.off)) & (1<<24 - 1)
+					x := remap(int32(v), site, 1<<24, decode)
+					if op == 0xE9 {
+						x = remapJump(int32(v), site, 1<<24, x86JumpReach, decode)
+					}
+					binary.LittleEndian.PutUint32(b[i+1-pos:], uint32(x))
+				}
+				i += 5
+			}
+		case ARM64:
+			// Instructions are 4-byte aligned in memory
+			i += int64(-(s.vaddr + uint64(i-s.off)) & 3)
+			for i+4 <= s.end && i < bend {
+				if i+4 > bend {
+					return i
+				}
+				insn := binary.LittleEndian.Uint32(b[i-pos:])
+				// BL and B differ only in their top bit
+				if op := insn & 0xFC000000; op == 0x94000000 || op == 0x14000000 {
+					site := int32((s.vaddr+uint64(i-s.off))>>2) & (1<<25 - 1)
+					x := remap(int32(insn<<6)>>6, site, 1<<25, decode)
+					if op == 0x14000000 {
+						x = remapJump(int32(insn<<6)>>6, site, 1<<25, arm64JumpReach, decode)
+					}
+					binary.LittleEndian.PutUint32(b[i-pos:], op|uint32(x)&0x03FFFFFF)
+				}
+				i += 4
+			}
+		}
+	}
+	return bend
+}
+
+// remap converts a branch displacement x in [-half, half) from the
+// instruction at site, in [0, half), to another value in that range, or
+// back if decode is set. Backward displacements become the target address
+// modulo half, and forward ones are negated and moved down by one; the
+// displacements that would give a negative target fill the remaining
+// values.
+func remap(x, site, half int32, decode bool) int32 {
+	if !decode {
+		switch {
+		case x >= 0:
+			return -x - 1
+		case x >= -site:
+			return site + x
+		default:
+			return x + half + site
+		}
+	}
+	switch {
+	case x < 0:
+		return -x - 1
+	case x < site:
+		return x - site
+	default:
+		return x - half - site
+	}
+}
+
+// remapJump converts a jump displacement x in [-half, half) from the
+// instruction at site, in [0, half), to another value in that range, or
+// back if decode is set. Displacements in [-reach, reach) are left as they
+// are, since most such jumps stay within a function and move with their
+// targets. The others are rotated by site among themselves, so that long
+// jumps to the same target become the same value.
+func remapJump(x, site, half, reach int32, decode bool) int32 {
+	if -reach <= x && x < reach {
+		return x
+	}
+	// Number the long displacements from 0 to n-1 in order
+	n := 2*half - 2*reach
+	i := x + half
+	if x >= reach {
+		i -= 2 * reach
+	}
+	if decode {
+		i -= site
+	} else {
+		i += site
+	}
+	if i = i % n; i < 0 {
+		i += n
+	}
+	if i >= half-reach {
+		i += 2 * reach
+	}
+	return i - half
+}
+
+// Encode returns a copy of b with id's filter applied. It returns b itself
+// if the filter leaves it unchanged.
+func (id ID) Encode(b []byte) []byte {
+	segs, _ := segments(b, id)
+	if len(segs) == 0 {
+		return b
+	}
+	out := append([]byte(nil), b...)
+	convert(id, segs, out, 0, 0, false)
+	return out
+}
+
+// Decode reverses Encode in place.
+func (id ID) Decode(b []byte) {
+	segs, _ := segments(b, id)
+	convert(id, segs, b, 0, 0, true)
+}
+
+// NewDecoder returns a writer that reverses id's filter on what is written
+// to it and writes the result to w. It buffers the ELF headers and up to
+// the length of an instruction, so it must be closed to write the rest.
+// Closing it does not close w.
+func (id ID) NewDecoder(w io.Writer) io.WriteCloser {
+	return &decoder{w: w, id: id}
+}
+
+type decoder struct {
+	w       io.Writer
+	id      ID
+	buf     []byte
+	pos     int64
+	next    int64
+	segs    []segment
+	decided bool
+}
+
+func (d *decoder) Write(p []byte) (int, error) {
+	if d.id == None {
+		return d.w.Write(p)
+	}
+	d.buf = append(d.buf, p...)
+	if !d.decided {
+		if d.segs, d.decided = segments(d.buf, d.id); !d.decided {
+			return len(p), nil
+		}
+	}
+	d.next = convert(d.id, d.segs, d.buf, d.pos, d.next, true)
+	n := d.next - d.pos
+	if _, err := d.w.Write(d.buf[:n]); err != nil {
+		return 0, err
+	}
+	d.pos = d.next
+	d.buf = append(d.buf[:0], d.buf[n:]...)
+	return len(p), nil
+}
+
+// Close writes the bytes held back, which were not filtered since they
+// don't hold a complete instruction or ELF header.
+func (d *decoder) Close() error {
+	if len(d.buf) == 0 {
+		return nil
+	}
+	_, err := d.w.Write(d.buf)
+	d.pos += int64(len(d.buf))
+	d.buf = d.buf[:0]
+	return err
+}
@@ -0,0 +1,264 @@
+package filter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+// makeELF returns an ELF file for machine whose single executable segment,
+// loaded at 0x400000, holds its headers followed by code.
+func makeELF(machine uint16, code []byte) []byte {
+	b := make([]byte, 64+56, 64+56+len(code))
+	copy(b, "\x7fELF\x02\x01\x01")
+	binary.LittleEndian.PutUint16(b[16:], 2)
+	binary.LittleEndian.PutUint16(b[18:], machine)
+	binary.LittleEndian.PutUint64(b[32:], 64)
+	binary.LittleEndian.PutUint16(b[54:], 56)
+	binary.LittleEndian.PutUint16(b[56:], 1)
+	ph := b[64:]
+	binary.LittleEndian.PutUint32(ph, 1)
+	binary.LittleEndian.PutUint32(ph[4:], 5)
+	binary.LittleEndian.PutUint64(ph[16:], 0x400000)
+	binary.LittleEndian.PutUint64(ph[32:], uint64(64+56+len(code)))
+	return append(b, code...)
+}
+
+// x86Code returns random code with a call or jump to target every few
+// bytes.
+func x86Code(rnd *rand.Rand, n int, target int) []byte {
+	var code []byte
+	for len(code) < n {
+		for i := rnd.Intn(8); i > 0; i-- {
+			code = append(code, byte(rnd.Intn(256)))
+		}
+		code = append(code, 0xE8+byte(rnd.Intn(2)))
+		code = binary.LittleEndian.AppendUint32(code, uint32(target-(64+56+len(code)+4)))
+	}
+	return code
+}
+
+// arm64Code returns random instructions with a BL or B to target every
+// few.
+func arm64Code(rnd *rand.Rand, n int, target int) []byte {
+	var code []byte
+	for len(code) < n {
+		for i := rnd.Intn(4); i > 0; i-- {
+			code = binary.LittleEndian.AppendUint32(code, rnd.Uint32())
+		}
+		imm := uint32((target-(64+56+len(code)))/4) & 0x03FFFFFF
+		code = binary.LittleEndian.AppendUint32(code, 0x14000000|uint32(rnd.Intn(2))<<31|imm)
+	}
+	return code
+}
+
+func TestDetect(t *testing.T) {
+	for _, test := range []struct {
+		b  []byte
+		id ID
+	}{
+		{makeELF(emX86_64, nil), X86_64},
+		{makeELF(emAArch64, nil), ARM64},
+		{makeELF(3, nil), None},
+		{[]byte("\x7fELF"), None},
+		{bytes.Repeat([]byte("not an executable"), 10), None},
+	} {
+		if id := Detect(test.b); id != test.id {
+			t.Errorf("Detect(%q...) = %v, want %v", test.b[:4], id, test.id)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for _, test := range []struct {
+		id   ID
+		file []byte
+	}{
+		// Long enough for jumps to the middle to be converted
+		{X86_64, makeELF(emX86_64, x86Code(rnd, 300000, 50000))},
+		{ARM64, makeELF(emAArch64, arm64Code(rnd, 300000, 50000))},
+		// Only files for the filter's machine are filtered
+		{X86_64, makeELF(emAArch64, arm64Code(rnd, 1000, 500))},
+		{ARM64, []byte("short")},
+	} {
+		enc := test.id.Encode(test.file)
+		filtered := Detect(test.file) == test.id
+		if filtered == bytes.Equal(enc, test.file) {
+			t.Errorf("%v: Encode changed the file: %v, want %v", test.id, !filtered, filtered)
+		}
+		dec := append([]byte(nil), enc...)
+		test.id.Decode(dec)
+		if !bytes.Equal(dec, test.file) {
+			t.Errorf("%v: Decode does not reverse Encode", test.id)
+		}
+		for _, chunk := range []int{1, 3, 7, 100, 4096} {
+			var out bytes.Buffer
+			w := test.id.NewDecoder(&out)
+			for b := enc; len(b) > 0; b = b[min(chunk, len(b)):] {
+				if _, err := w.Write(b[:min(chunk, len(b))]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out.Bytes(), test.file) {
+				t.Errorf("%v: decoder writing %v bytes at a time does not reverse Encode", test.id, chunk)
+			}
+		}
+	}
+}
+
+// TestAbsoluteTargets checks that backward calls to the same target from
+// different places are the same once filtered.
+func TestAbsoluteTargets(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	for _, test := range []struct {
+		id   ID
+		file []byte
+	}{
+		{X86_64, makeELF(emX86_64, x86Code(rnd, 10000, 0))},
+		{ARM64, makeELF(emAArch64, arm64Code(rnd, 10000, 0))},
+	} {
+		enc := test.id.Encode(test.file)
+		calls := map[uint32]int{}
+		if test.id == X86_64 {
+			for i := 120; i+5 <= len(enc); {
+				switch enc[i] {
+				case 0xE8:
+					calls[binary.LittleEndian.Uint32(enc[i+1:])]++
+					i += 5
+				case 0xE9:
+					i += 5
+				default:
+					i++
+				}
+			}
+		} else {
+			for i := 120; i+4 <= len(enc); i += 4 {
+				if insn := binary.LittleEndian.Uint32(enc[i:]); insn&0xFC000000 == 0x94000000 {
+					calls[insn]++
+				}
+			}
+		}
+		var most int
+		for _, n := range calls {
+			most = max(most, n)
+		}
+		if most < len(calls) {
+			t.Errorf("%v: most common filtered call appears %v times among %v distinct ones", test.id, most, len(calls))
+		}
+	}
+}
+
+// makeExecutable returns an x86-64 ELF file whose code calls or jumps to
+// functions in its first 4 KiB every few bytes. extra is inserted in the
+// middle of the code, moving the branches after it but not their targets.
+func makeExecutable(extra []byte) []byte {
+	rnd := rand.New(rand.NewSource(1))
+	code := make([]byte, 4096)
+	rnd.Read(code)
+	for len(code) < 1<<20 {
+		if len(code) >= 1<<19 && extra != nil {
+			code = append(code, extra...)
+			extra = nil
+		}
+		for i := rnd.Intn(8); i > 0; i-- {
+			code = append(code, byte(rnd.Intn(0xE8)))
+		}
+		target := rnd.Intn(64) * 64
+		code = append(code, 0xE8+byte(rnd.Intn(2)))
+		code = binary.LittleEndian.AppendUint32(code, uint32(target-len(code)-4))
+	}
+	return makeELF(emX86_64, code)
+}
+
+// TestMovedCode checks that the calls and long jumps that code inserted
+// before them moves away from their targets are the same once filtered.
+func TestMovedCode(t *testing.T) {
+	extra := []byte("inserted code")
+	oldbs, newbs := makeExecutable(nil), makeExecutable(extra)
+	// The files are the same up to the inserted code, but for the segment
+	// size in the program header
+	at := 64 + 56 + 1<<19
+	for oldbs[at] == newbs[at] {
+		at++
+	}
+	n := len(newbs) - at - len(extra)
+	if bytes.Equal(oldbs[at:at+n], newbs[at+len(extra):]) {
+		t.Fatal("inserted code moved no branches")
+	}
+	oldenc, newenc := X86_64.Encode(oldbs), X86_64.Encode(newbs)
+	if !bytes.Equal(oldenc[at:at+n], newenc[at+len(extra):]) {
+		t.Error("filtered branches after the inserted code changed")
+	}
+}
+
+// TestRemap checks that remap and remapJump are bijections that decoding
+// reverses, on a small range.
+func TestRemap(t *testing.T) {
+	const half, reach = 64, 8
+	for site := int32(0); site < half; site++ {
+		for _, jump := range []bool{false, true} {
+			f := func(x int32, decode bool) int32 {
+				if jump {
+					return remapJump(x, site, half, reach, decode)
+				}
+				return remap(x, site, half, decode)
+			}
+			seen := map[int32]bool{}
+			for x := int32(-half); x < half; x++ {
+				y := f(x, false)
+				if y < -half || y >= half || seen[y] {
+					t.Fatalf("site %v, jump %v: %v encodes to %v twice or out of range", site, jump, x, y)
+				}
+				seen[y] = true
+				if x2 := f(y, true); x2 != x {
+					t.Fatalf("site %v, jump %v: %v encodes to %v, which decodes to %v", site, jump, x, y, x2)
+				}
+				if jump && -reach <= x && x < reach && y != x {
+					t.Fatalf("site %v: short jump %v encodes to %v", site, x, y)
+				}
+			}
+		}
+	}
+	// Long jumps to the same target from different sites are the same
+	// once filtered
+	if a, b := remapJump(-20, 30, half, reach, false), remapJump(-40, 50, half, reach, false); a != b {
+		t.Error("long jumps to the same target encode to", a, "and", b)
+	}
+}
+
+func TestRoundTripExecutable(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Skip(err)
+	}
+	file, err := ioutil.ReadFile(exe)
+	if err != nil {
+		t.Skip(err)
+	}
+	id := Detect(file)
+	if id == None {
+		t.Skip("test binary is not a supported ELF executable")
+	}
+	enc := id.Encode(file)
+	if bytes.Equal(enc, file) {
+		t.Fatal("Encode left the test binary unchanged")
+	}
+	var out bytes.Buffer
+	w := id.NewDecoder(&out)
+	for b := enc; len(b) > 0; b = b[min(4093, len(b)):] {
+		w.Write(b[:min(4093, len(b))])
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), file) {
+		t.Fatal("decoder does not reverse Encode on the test binary")
+	}
+}